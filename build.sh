@@ -55,7 +55,7 @@ echo -e "${GREEN}  ✓${NC} Module initialized"
 
 # Build
 echo -e "${BLUE}[2/4]${NC} Building optimized binary..."
-CGO_ENABLED=0 go build -ldflags="-s -w" -o build/cloudlab cloudlab.go
+CGO_ENABLED=0 go build -ldflags="-s -w" -o build/cloudlab .
 
 if [ ! -f "build/cloudlab" ]; then
     echo -e "${RED}  ✗ Build failed!${NC}"
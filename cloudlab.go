@@ -8,22 +8,38 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/smtp"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -58,26 +74,84 @@ const (
 
 // Configuration
 type Config struct {
-	JupyterPort     int        `json:"jupyter_port"`
-	VSCodePort      int        `json:"vscode_port"`
-	SSHPort         int        `json:"ssh_port"`
-	DashboardPort   int        `json:"dashboard_port"`
-	PythonVersion   string     `json:"python_version"`
-	JupyterPassword string     `json:"jupyter_password"`
-	VSCodePassword  string     `json:"vscode_password"`
-	SSHUser         string     `json:"ssh_user"`
-	SSHPassword     string     `json:"ssh_password"`
-	JupyterMode     string     `json:"jupyter_mode"`
-	WorkDir         string     `json:"working_directory"`
-	Email           string     `json:"email_address"`
-	EmailPassword   string     `json:"email_app_password"`
-	SMTPServer      string     `json:"smtp_server"`
-	SMTPPort        int        `json:"smtp_port"`
-	EnableMPS       bool       `json:"enable_mps"`
-	EnableCUDA      bool       `json:"enable_cuda"`
-	LowPowerMode    bool       `json:"low_power_mode"`
-	NotifyOnStart   bool       `json:"notify_on_start"`
-	TunnelURLs      TunnelURLs `json:"tunnel_urls"`
+	SchemaVersion   int               `json:"schema_version"`
+	JupyterPort     int               `json:"jupyter_port"`
+	JupyterSocket   string            `json:"jupyter_socket,omitempty"`
+	DefaultEnv      string            `json:"default_env,omitempty"`
+	EnvDirs         map[string]string `json:"env_dirs,omitempty"`
+	BindAddress     string            `json:"bind_address,omitempty"`
+	VSCodePort      int               `json:"vscode_port"`
+	SSHPort         int               `json:"ssh_port"`
+	DashboardPort   int               `json:"dashboard_port"`
+	PythonVersion   string            `json:"python_version"`
+	JupyterPassword string            `json:"jupyter_password"`
+	VSCodePassword  string            `json:"vscode_password"`
+	ViewerPassword  string            `json:"viewer_password,omitempty"`
+	ViewerPort      int               `json:"viewer_port,omitempty"`
+	SSHUser         string            `json:"ssh_user"`
+	SSHPassword     string            `json:"ssh_password"`
+	SSHHost         string            `json:"ssh_host,omitempty"`
+	JupyterMode     string            `json:"jupyter_mode"`
+	WorkDir         string            `json:"working_directory"`
+	Email           string            `json:"email_address"`
+	InstanceName    string            `json:"instance_name,omitempty"`
+	EmailPassword   string            `json:"email_app_password"`
+	SMTPServer      string            `json:"smtp_server"`
+	SMTPPort        int               `json:"smtp_port"`
+	SMTPTimeout     int               `json:"smtp_timeout"`
+	SMTPCACert      string            `json:"smtp_ca_cert,omitempty"`
+	SMTPClientCert  string            `json:"smtp_client_cert,omitempty"`
+	SMTPClientKey   string            `json:"smtp_client_key,omitempty"`
+	SMTPInsecure    bool              `json:"smtp_insecure_skip_verify,omitempty"`
+	SMTPPasswordCmd string            `json:"smtp_password_command,omitempty"`
+	EnableMPS       bool              `json:"enable_mps"`
+	EnableCUDA      bool              `json:"enable_cuda"`
+	UseSysJupyter   bool              `json:"use_system_jupyter,omitempty"`
+	JupyterEnabled  bool              `json:"jupyter_enabled"`
+	VSCodeEnabled   bool              `json:"vscode_enabled"`
+	SSHEnabled      bool              `json:"ssh_enabled"`
+	TunnelEnabled   bool              `json:"tunnel_enabled"`
+	RunAsUser       string            `json:"run_as_user,omitempty"`
+	OfflineDir      string            `json:"offline_dir,omitempty"`
+	PythonExe       string            `json:"python_executable,omitempty"`
+	StrictPasswords bool              `json:"strict_passwords,omitempty"`
+	UseSysVSCode    bool              `json:"use_system_vscode,omitempty"`
+	LowPowerMode    bool              `json:"low_power_mode"`
+	NotifyOnStart   bool              `json:"notify_on_start"`
+	DesktopNotify   bool              `json:"desktop_notify,omitempty"`
+	IdleTimeout     int               `json:"idle_timeout"`
+	IdleNotify      bool              `json:"idle_notify"`
+	StartupTimeout  int               `json:"startup_timeout"`
+	StartMode       string            `json:"default_start_mode,omitempty"`
+	InstallTimeout  int               `json:"install_timeout"`
+	TunnelProtocol  string            `json:"tunnel_protocol,omitempty"`
+	TunnelRegion    string            `json:"tunnel_region,omitempty"`
+	TunnelPattern   string            `json:"tunnel_url_pattern,omitempty"`
+	TunnelGrace     int               `json:"tunnel_grace_period,omitempty"`
+	TerminalBackend string            `json:"terminal_backend,omitempty"`
+	JupyterArgs     []string          `json:"jupyter_extra_args,omitempty"`
+	VSCodeArgs      []string          `json:"vscode_extra_args,omitempty"`
+	TerminalArgs    []string          `json:"ttyd_extra_args,omitempty"`
+	TunnelURLs      TunnelURLs        `json:"tunnel_urls"`
+	Terminals       []Terminal        `json:"ssh_terminals,omitempty"`
+
+	NamedTunnels map[string]NamedTunnel `json:"named_tunnels,omitempty"`
+	Projects     map[string]Project     `json:"projects,omitempty"`
+}
+
+type Terminal struct {
+	Name      string `json:"name"`
+	Port      int    `json:"port"`
+	Dir       string `json:"dir,omitempty"`
+	Tunnel    bool   `json:"tunnel,omitempty"`
+	TunnelURL string `json:"tunnel_url,omitempty"`
+}
+
+// NamedTunnel routes a service through a cloudflared tunnel created with
+// `cloudflared tunnel create`, so its URL stays the same across restarts.
+type NamedTunnel struct {
+	Tunnel   string `json:"tunnel"`
+	Hostname string `json:"hostname"`
 }
 
 type TunnelURLs struct {
@@ -85,10 +159,29 @@ type TunnelURLs struct {
 	VSCode    string `json:"vscode"`
 	SSH       string `json:"ssh"`
 	Dashboard string `json:"dashboard"`
+	Viewer    string `json:"viewer,omitempty"`
 }
 
+const tunnelAttempts = 3
+
 var (
-	config      Config
+	config   Config
+	configMu sync.Mutex
+
+	autoPortFlag bool
+	verboseFlag  bool
+	logFormat    = "text"
+	forceFlag    bool
+	offlineFlag  bool
+	reinstalling bool
+	noTunnelFlag bool
+	keepURLsFlag bool
+	tunnelWait   = 30 * time.Second
+	userPath     string
+	pythonFlag   string
+	timeoutFlag  time.Duration
+	// rootCtx ends at --deadline; long-running helpers and waits watch it.
+	rootCtx     = context.Background()
 	homeDir     string
 	cloudlabDir string
 	configPath  string
@@ -97,19 +190,115 @@ var (
 func main() {
 	runtime.GOMAXPROCS(1)
 
-	homeDir, _ = os.UserHomeDir()
-	cloudlabDir = filepath.Join(homeDir, ".cloudlab")
-	configPath = filepath.Join(cloudlabDir, "config.json")
+	homeDir = resolveHome()
+	resolveDirs()
 
+	os.MkdirAll(filepath.Dir(configPath), 0755)
 	os.MkdirAll(cloudlabDir, 0755)
 	os.MkdirAll(filepath.Join(cloudlabDir, "logs"), 0755)
 	os.MkdirAll(filepath.Join(cloudlabDir, "pids"), 0755)
 	os.MkdirAll(filepath.Join(cloudlabDir, "envs"), 0755)
+	userPath = os.Getenv("PATH")
+	// Tools installed from offline_dir live here; make them findable like any other.
+	// ~/.local/bin goes last: it's where binaries land when sudo isn't usable.
+	os.Setenv("PATH", filepath.Join(cloudlabDir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH")+
+		string(os.PathListSeparator)+filepath.Join(homeDir, ".local", "bin"))
+
+	// Global flags are only read before "--"; what follows belongs to the
+	// command run by env run / env pip and is passed through untouched.
+	var passthrough []string
+	for i, a := range os.Args {
+		if a == "--" {
+			passthrough = os.Args[i:]
+			os.Args = os.Args[:i:i]
+			break
+		}
+	}
+
+	if f := flagValue(os.Args[1:], "--output"); f == "json" || hasFlag(os.Args[1:], "--json") {
+		beginJSONOutput()
+		defer func() {
+			// A panic must crash as usual, not end up reported as {"ok":true}.
+			if r := recover(); r != nil {
+				outputJSON = false
+				os.Stdout = realStdout
+				panic(r)
+			}
+			exit(0)
+		}()
+		os.Args = removeArg(removeFlag(os.Args, "--output"), "--json")
+	} else if f != "" && f != "text" {
+		printErrorCode(codeInvalid, "--output must be text or json")
+		os.Exit(2)
+	}
+	if f := flagValue(os.Args[1:], "--env-file"); f != "" {
+		if err := loadEnvFile(expandPath(f)); err != nil {
+			printErrorCode(errCode(err), "--env-file: "+err.Error())
+			exit(2)
+		}
+		os.Args = removeFlag(os.Args, "--env-file")
+	}
 
 	loadConfig()
 
+	if hasFlag(os.Args[1:], "--verbose") {
+		verboseFlag = true
+		os.Args = removeArg(os.Args, "--verbose")
+	}
+	if f := flagValue(os.Args[1:], "--log-format"); f != "" {
+		if f != "text" && f != "json" {
+			printErrorCode(codeInvalid, "--log-format must be text or json")
+			exit(2)
+		}
+		logFormat = f
+		os.Args = removeFlag(os.Args, "--log-format")
+	}
+	if f := flagValue(os.Args[1:], "--timeout"); f != "" {
+		d, err := parseMinutes(f)
+		if err != nil || d <= 0 {
+			printErrorCode(codeInvalid, "--timeout must be a duration like 10m or a number of minutes")
+			exit(2)
+		}
+		timeoutFlag = d
+		os.Args = removeFlag(os.Args, "--timeout")
+	}
+	if f := flagValue(os.Args[1:], "--python-path"); f != "" {
+		pythonFlag = expandPath(f)
+		if _, err := checkPython(pythonFlag); err != nil {
+			printErrorCode(errCode(err), "--python-path: "+err.Error())
+			exit(2)
+		}
+		os.Args = removeFlag(os.Args, "--python-path")
+	}
+	if f := flagValue(os.Args[1:], "--deadline"); f != "" {
+		d, err := time.ParseDuration(f)
+		if n, convErr := strconv.Atoi(f); convErr == nil {
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d <= 0 {
+			printErrorCode(codeInvalid, "--deadline must be a duration like 90s or 10m")
+			exit(2)
+		}
+		var cancel context.CancelFunc
+		rootCtx, cancel = context.WithTimeout(context.Background(), d)
+		defer cancel()
+		defer exitIfDeadline(d)
+		go func() {
+			<-rootCtx.Done()
+			// Give killed helpers a moment to unwind, then stop regardless.
+			time.Sleep(3 * time.Second)
+			exitIfDeadline(d)
+		}()
+		os.Args = removeFlag(os.Args, "--deadline")
+	}
+	os.Args = append(os.Args, passthrough...)
+
 	if len(os.Args) < 2 {
-		showHelp()
+		if isTerminal(os.Stdin) {
+			showMenu()
+		} else {
+			showHelp()
+		}
 		return
 	}
 
@@ -120,40 +309,120 @@ func main() {
 	case "init":
 		initSetup()
 	case "install":
-		if len(args) > 0 {
-			installComponent(args[0])
+		forceFlag = hasFlag(args, "--force")
+		if offlineFlag = hasFlag(args, "--offline"); offlineFlag && !checkOfflineDir() {
+			return
+		}
+		if names := positional(args); len(names) > 0 {
+			installComponent(names[0])
 		} else {
 			installAll()
 		}
+	case "reinstall":
+		names := positional(args)
+		if len(names) < 1 {
+			printErrorCode(codeUsage, "Usage: cloudlab reinstall <component> [--yes]")
+			return
+		}
+		forceFlag = hasFlag(args, "--force")
+		if offlineFlag = hasFlag(args, "--offline"); offlineFlag && !checkOfflineDir() {
+			return
+		}
+		reinstallComponent(names[0], hasFlag(args, "--yes", "-y"))
 	case "start":
-		if len(args) > 0 {
-			startService(args[0])
+		names := positional(args)
+		autoPortFlag = hasFlag(args, "--auto-port")
+		noTunnelFlag = hasFlag(args, "--no-tunnel")
+		if hasFlag(args, "--recreate-config") {
+			target := "all"
+			if len(names) > 0 {
+				target = names[0]
+			}
+			if !recreateConfig(target) {
+				return
+			}
+		}
+		if len(names) > 0 {
+			startService(names[0])
+			if name, ok := tunnelTarget(names[0]); ok && hasFlag(args, "--tunnel") {
+				startOneTunnel(name)
+			}
 		} else {
 			startAll()
 		}
+		if startForeground(args) {
+			waitForeground()
+		}
 	case "stop":
-		if len(args) > 0 {
-			stopService(args[0])
+		keepURLsFlag = hasFlag(args, "--keep-urls")
+		if names := positional(args); len(names) > 0 {
+			stopService(names[0])
 		} else {
 			stopAll()
 		}
 	case "restart":
-		if len(args) > 0 {
-			stopService(args[0])
-			time.Sleep(2 * time.Second)
-			startService(args[0])
-		} else {
+		noTunnelFlag = hasFlag(args, "--no-tunnel")
+		names := positional(args)
+		switch {
+		case hasFlag(args, "--rolling") && len(names) > 0:
+			rollingRestart(names[0])
+		case hasFlag(args, "--rolling"):
+			for _, svc := range services() {
+				if svc.Enabled() {
+					rollingRestart(svc.Name)
+				}
+			}
+		case len(names) > 0:
+			stopService(names[0])
+			waitReleased(names[0])
+			startService(names[0])
+		default:
 			stopAll()
-			time.Sleep(2 * time.Second)
+			waitReleased("all")
 			startAll()
 		}
 	case "status":
-		showStatus()
+		if hasFlag(args, "--watch", "-w") {
+			interval, err := time.ParseDuration(flagValue(args, "--interval"))
+			if err != nil || interval <= 0 {
+				interval = 3 * time.Second
+			}
+			watchStatus(interval)
+		} else if names := positional(args, "--service", "--interval"); len(names) > 0 {
+			exit(serviceStatus(names[0]))
+		} else if name := flagValue(args, "--service"); name != "" {
+			exit(serviceStatus(name))
+		} else {
+			showStatus()
+		}
+	case "health":
+		exit(health(hasFlag(args, "--http")))
+	case "resume":
+		resume()
+	case "jupyter":
+		if len(args) == 0 || args[0] != "token" {
+			printErrorCode(codeUsage, "Usage: cloudlab jupyter token")
+			return
+		}
+		jupyterAccess()
+	case "info", "summary":
+		showInfo()
+	case "open-config-dir", "open-dir":
+		openCloudlabDir()
 	case "logs":
-		if len(args) > 0 {
-			showLogs(args[0])
+		if hasFlag(args, "--size", "--sizes") {
+			showLogSizes()
+		} else if names := positional(args, "--tail", "-n"); len(names) > 0 && names[0] == "export" {
+			if len(names) < 3 {
+				fmt.Println("Usage: cloudlab logs export <service|all> <file> [--tail n]")
+				return
+			}
+			exportLogs(names[1], names[2], logTail(args, 0))
+		} else if names := positional(args, "--grep", "-C", "--tail", "-n", "--since"); len(names) > 0 {
+			showLogs(names[0], args)
 		} else {
-			fmt.Println("Usage: cloudlab logs <service>")
+			fmt.Println("Usage: cloudlab logs <service> [--grep <pattern>] [-C n] [--tail n] [-f]")
+			fmt.Println("       cloudlab logs export <service|all> <file> [--tail n]")
 		}
 	case "config":
 		if len(args) > 0 {
@@ -163,7 +432,7 @@ func main() {
 		}
 	case "tunnel":
 		if len(args) > 0 {
-			handleTunnel(args[0])
+			handleTunnel(args)
 		} else {
 			showTunnelStatus()
 		}
@@ -179,6 +448,8 @@ func main() {
 		} else {
 			listEnvs()
 		}
+	case "project", "projects":
+		handleProject(args)
 	case "email":
 		if len(args) > 0 {
 			handleEmail(args[0])
@@ -187,7 +458,7 @@ func main() {
 		}
 	case "ssh":
 		if len(args) > 0 {
-			handleSSH(args[0])
+			handleSSH(args)
 		} else {
 			showSSHStatus()
 		}
@@ -197,21 +468,101 @@ func main() {
 		} else {
 			showDashboardStatus()
 		}
+	case "idle":
+		if len(args) > 0 {
+			handleIdle(args[0])
+		} else {
+			showIdleStatus()
+		}
+	case "serve":
+		serve()
+	case "serve-dir":
+		dirs := positional(args, "--port")
+		if len(dirs) < 1 {
+			printErrorCode(codeUsage, "Usage: cloudlab serve-dir <path> [--port N] [--email]")
+			return
+		}
+		serveDir(dirs[0], flagValue(args, "--port"), hasFlag(args, "--email"))
+	case "fetch":
+		files := positional(args)
+		if len(files) < 1 {
+			printErrorCode(codeUsage, "Usage: cloudlab fetch <remote-path> [local-path] [--tunnel]")
+			return
+		}
+		local := filepath.Base(files[0])
+		if len(files) > 1 {
+			local = files[1]
+		}
+		fetchFile(files[0], local, hasFlag(args, "--tunnel"))
 	case "update":
 		updateAll()
 	case "uninstall":
 		uninstallAll()
+	case "selftest", "test":
+		exit(selftest())
+	case "audit":
+		exit(audit())
+	case webTerminalCmd:
+		runWebTerminal(args)
+	case "--list-services":
+		printList(serviceNames())
+	case "--list-commands":
+		printList(commands)
 	case "help", "-h", "--help":
 		showHelp()
 	case "version", "-v", "--version":
 		showVersion()
+		if hasFlag(args, "--components") {
+			showComponentVersions(hasFlag(args, "--save"))
+		}
 	default:
-		printError("Unknown command: " + cmd)
+		printErrorCode(codeUnknown, "Unknown command: "+cmd)
 		showHelp()
 	}
 }
 
+// commands are the top-level commands, without aliases, for
+// --list-commands. Keep in step with the switch in main.
+var commands = []string{
+	"init", "install", "reinstall", "start", "stop", "restart", "resume", "status", "health", "info",
+	"logs", "config", "tunnel", "kernel", "env", "project", "email", "ssh", "dashboard", "idle",
+	"jupyter", "serve", "serve-dir", "fetch", "update", "uninstall", "selftest", "audit",
+	"open-config-dir", "help", "version",
+}
+
+// serviceNames lists what start/stop/logs accept: each service, named
+// terminals, then their tunnels.
+func serviceNames() []string {
+	var names, tunnels []string
+	for _, svc := range services() {
+		names = append(names, svc.Name)
+		tunnels = append(tunnels, svc.TunnelName())
+	}
+	for _, t := range config.Terminals {
+		names = append(names, t.pidName())
+		if t.Tunnel {
+			tunnels = append(tunnels, "tunnel_"+t.pidName())
+		}
+	}
+	return append(names, tunnels...)
+}
+
+// printList prints one name per line for scripts, or the list as data
+// with --output json.
+func printList(names []string) {
+	if outputJSON {
+		setJSONData(names)
+		return
+	}
+	for _, n := range names {
+		fmt.Println(n)
+	}
+}
+
 func getLogo() string {
+	if outputJSON {
+		return ""
+	}
 	return fmt.Sprintf(`
 %s%s   _____ _                 _ _           _     %s
 %s%s  / ____| |               | | |         | |    %s
@@ -235,6 +586,43 @@ func getLogo() string {
 		BrightBlue, Underline, GITHUB, Reset)
 }
 
+func showMenu() {
+	fmt.Println(getLogo())
+	reader := bufio.NewReader(os.Stdin)
+	items := []struct {
+		label string
+		run   func()
+	}{
+		{"Initialize (init)", initSetup},
+		{"Install components", installAll},
+		{"Start all services", startAll},
+		{"Show status", showStatus},
+		{"Show tunnel URLs", showTunnelStatus},
+	}
+	for {
+		printHeader("☁️  MENU")
+		for i, item := range items {
+			fmt.Printf("  %s%d)%s %s\n", BrightCyan, i+1, Reset, item.label)
+		}
+		fmt.Printf("  %sq)%s Quit\n", BrightCyan, Reset)
+		fmt.Printf("\n%sChoose%s [1-%d/q]: ", Bold, Reset, len(items))
+
+		input := strings.ToLower(readLine(reader))
+		if input == "q" || input == "quit" || input == "exit" {
+			return
+		}
+		n, err := strconv.Atoi(input)
+		if err != nil || n < 1 || n > len(items) {
+			if input == "" {
+				return
+			}
+			printErrorCode(codeInvalid, "Invalid choice: "+input)
+			continue
+		}
+		items[n-1].run()
+	}
+}
+
 func showVersion() {
 	fmt.Printf("%s☁️  CloudLab CLI v%s%s\n", BrightCyan, VERSION, Reset)
 	fmt.Printf("%sAuthor: %s%s\n", Dim, AUTHOR, Reset)
@@ -249,21 +637,51 @@ func showHelp() {
 
 %sSERVICES:%s
   init                    Initialize CloudLab
-  install [component]     Install (all|jupyter|vscode|ssh|dashboard|cloudflare|uv)
-  start [service]         Start (all|jupyter|lab|notebook|vscode|ssh|dashboard|tunnel)
+  install [component]     Install (all|jupyter|vscode|ssh|gotty|dashboard|cloudflare|uv)
+                          --offline uses binaries and wheels from offline_dir
+                          --force installs even when disk space looks too low
+  reinstall <component>   Stop, delete and install a component again [--yes]
+  start [service]         Start (all|jupyter|lab|notebook|vscode|ssh|dashboard|viewer|tunnel)
+                          --wait stays in the foreground until SIGTERM/Ctrl+C
+                          (--foreground, --detach=false); --detach overrides default_start_mode
+                          --auto-port picks free ports (also: config set <svc>_port 0)
+                          --no-tunnel skips tunnels; --tunnel also tunnels one service
+                          --recreate-config rewrites the Jupyter/code-server config files first
   stop [service]          Stop services
   restart [service]       Restart services
-  status                  Show all status
+                          --rolling starts the new Jupyter/VS Code/dashboard before stopping the old
+  resume                  Start whatever was running before a reboot, plus its tunnels
+  jupyter token           Print shareable Jupyter URLs (with ?token= if token access is on)
+  status                  Show all status [-w/--watch] [--interval 5s]
+  status <service>        Show one service; exits 3 if it isn't running
+  health [--http]         Check running services answer; --http logs in to Jupyter's API
+  logs <service>          Show logs [--grep pattern] [-C n] [--tail n] [-f] [--no-color]
+                          [--since 10m]
+  logs all                Interleave every log, prefixed by service [-f] [--tail n]
+                          [--since 10m] [--grep pattern]
+  logs --size             Show how much disk each log file uses
+  logs export <svc> <f>   Copy a log with passwords redacted [--tail n]
+                          "all" with a .tar.gz bundles every log and the redacted config
+  serve                   Install if needed, start everything and supervise
+  info                    Compact summary of services, URLs and config
 
 %sTUNNELS:%s
-  tunnel start            Start all Cloudflare tunnels
-  tunnel stop             Stop all tunnels
-  tunnel restart          Get new URLs
+  tunnel start [service]  Start all Cloudflare tunnels, or just one
+                          --quick-timeout 30s: how long to wait for a URL
+  tunnel stop [service]   Stop all tunnels, or just one [--keep-urls]
+  tunnel restart [svc]    Get new URLs
   tunnel status           Show tunnel URLs
+  tunnel test [service]   Request each tunnel URL from outside; exits 1 if any fails
+  tunnel metrics          Show request/connection counts per tunnel
+  tunnel history          Show previously issued tunnel URLs
+  tunnel named <svc> <tunnel> <host>
+                          Use a named tunnel with a fixed hostname (<svc> none to undo)
 
 %sSSH TERMINAL:%s
   ssh start               Start web SSH terminal
-  ssh stop                Stop SSH terminal
+  ssh start <name>        Start a named terminal [--dir path] [--port n] [--tunnel]
+  ssh stop [name]         Stop SSH terminal
+  ssh remove <name>       Remove a named terminal
   ssh config              Configure SSH settings
   ssh status              Show SSH status
 
@@ -272,16 +690,47 @@ func showHelp() {
   dashboard stop          Stop dashboard
   dashboard status        Show dashboard status
 
+%sIDLE SHUTDOWN:%s
+  idle start              Start idle monitor (config set idle_timeout <min>)
+  idle stop               Stop idle monitor
+  idle status             Show idle monitor status
+
 %sKERNELS:%s
   kernel list             List Jupyter kernels
-  kernel add <name> [ver] Add kernel with Python version
+  kernel add <name> [ver] Add kernel with Python version [--display-name "My Project"]
+                          PyTorch follows enable_mps/enable_cuda; --no-gpu skips it, --gpu forces it
+                          --force recreates an existing kernel environment
+                          --offline installs from offline_dir's wheelhouse
   kernel remove <name>    Remove kernel
+  kernel info <name>      Show a kernel's Python and isolation
+  kernel export <n> <f>   Save kernelspec, Python version and packages to a file
+  kernel import <file>    Recreate the env and kernelspec from an export [--force]
 
 %sENVIRONMENTS:%s
   env list                List Python environments
-  env create <name> <ver> Create new environment
+  env create <name> <ver> Create new environment (--force recreates an existing one)
+                          --torch adds PyTorch for MPS, CUDA or CPU per enable_mps/enable_cuda
+                          --dir <path> puts the venv in a project directory
   env remove <name>       Remove environment
+                          --all-unused removes envs no kernel uses [--yes]
   env install <pkg>       Install package
+  env shell <name>        Open a shell with the environment activated
+  env run <name> -- <cmd> Run a command inside an environment
+  env pip <name> -- <args>
+                          Run uv pip with any arguments against an environment
+  env upgrade <name>      Upgrade all packages [--dry-run]
+  env requirements add <name> <pkg...>
+                          Install and track packages in the env's requirements.txt
+                          (also: list, remove, sync [--exact removes untracked packages])
+  env default [name]      Show or set the env used by Jupyter and env install
+  env size [name]         Show disk usage per environment
+
+%sPROJECTS:%s
+  project list            List projects; ★ marks the one in working_directory
+  project add <name> <dir> [--env <env>]
+                          Save a project directory, optionally with its own default env
+  project use <name>      Switch working_directory to a project, and the default env if it has one
+  project remove <name>   Forget a project (its files are left alone)
 
 %sEMAIL:%s
   email setup             Setup email notifications
@@ -290,14 +739,38 @@ func showHelp() {
 
 %sCONFIG:%s
   config                  Show configuration
-  config set <key> <val>  Set config value
-  config reset            Reset to defaults
+  config set <key> <val>  Set config value (--strict also resolves smtp_server)
+  config enable <key>     Turn a boolean setting on
+  config disable <key>    Turn a boolean setting off
+  config unset <key>      Put one key back to its default
+  config reset            Reset to defaults (backs up the old file; --yes skips the prompt)
+  config path             Print the config file location
+  config migrate          Upgrade an older config.json (done automatically on load)
+  config edit             Edit the config in $EDITOR (validated before saving)
 
 %sOTHER:%s
+  fetch <remote> [local]  Download a file via Jupyter [--tunnel]
+  serve-dir <path>        Share a directory through a quick tunnel [--port N] [--email]
   update                  Update components
   uninstall               Uninstall CloudLab
+  selftest                Verify env, kernel and Jupyter work end to end
+  audit                   List exposed services; exits 1 on high-risk exposure
+  open-config-dir         Open the CloudLab folder (logs, pids, config) in the file manager
   help                    Show this help
-  version                 Show version
+  version                 Show version [--components [--save]] for installed tool versions
+
+%sGLOBAL FLAGS:%s
+  --verbose               Show output of installers, pip and tunnel startup
+  --log-format json       Emit lifecycle events (starts, tunnel URLs, crashes) as JSON lines
+  --timeout <duration>    Kill installer, pip and download steps after this long (default 10m)
+  --list-services         Print service and tunnel names, one per line (for completion)
+  --list-commands         Print top-level commands, one per line
+  --output json           Print one JSON object (ok, error, code, messages, output) instead of text
+  --deadline <duration>   Fail with exit code 124 if the command is still running after this (CI)
+  --env-file <path>       Load KEY=VALUE lines (e.g. CLOUDLAB_JUPYTER_PASSWORD) before reading config
+  --python-path <path>    Build venvs from this interpreter instead of a uv-managed Python
+
+Run %scloudlab%s without arguments for an interactive menu.
 
 %sEXAMPLES:%s
   cloudlab init
@@ -306,117 +779,1217 @@ func showHelp() {
   cloudlab tunnel start
   cloudlab email send
   cloudlab kernel add mykernel 3.10
-`, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset)
+`, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset, Bold, Reset)
 }
 
 // ==================== Config ====================
 
+// resolveHome returns the user's home directory. Without HOME (some
+// containers, cron) it falls back to $CLOUDLAB_HOME or a temp directory
+// rather than silently writing .cloudlab into the working directory.
+func resolveHome() string {
+	home, err := os.UserHomeDir()
+	if err == nil && filepath.IsAbs(home) {
+		return home
+	}
+	if dir := os.Getenv("CLOUDLAB_HOME"); filepath.IsAbs(dir) {
+		return dir
+	}
+	fallback := filepath.Join(os.TempDir(), "cloudlab")
+	os.MkdirAll(fallback, 0700)
+	printWarning(fmt.Sprintf("Could not determine home directory (%v); using %s. Set HOME or CLOUDLAB_HOME to choose another location.", err, fallback))
+	return fallback
+}
+
+func resolveDirs() {
+	cloudlabDir = filepath.Join(homeDir, ".cloudlab")
+	configPath = filepath.Join(cloudlabDir, "config.json")
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	dataDir := filepath.Join(xdgDir("XDG_DATA_HOME", filepath.Join(homeDir, ".local", "share")), "cloudlab")
+	cfgDir := filepath.Join(xdgDir("XDG_CONFIG_HOME", filepath.Join(homeDir, ".config")), "cloudlab")
+	if !migrateLegacyDir(cloudlabDir, dataDir, cfgDir) {
+		return
+	}
+	cloudlabDir = dataDir
+	configPath = filepath.Join(cfgDir, "config.json")
+}
+
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return fallback
+}
+
+// migrateLegacyDir moves a pre-XDG ~/.cloudlab into the data directory and
+// leaves a symlink behind, so venv scripts and kernelspecs that embed the old
+// path keep working. It reports whether the XDG locations should be used.
+func migrateLegacyDir(legacy, dataDir, cfgDir string) bool {
+	info, err := os.Lstat(legacy)
+	if err != nil || !info.IsDir() {
+		return true
+	}
+	if _, err := os.Stat(dataDir); err == nil {
+		return false
+	}
+
+	os.MkdirAll(filepath.Dir(dataDir), 0755)
+	if err := os.Rename(legacy, dataDir); err != nil {
+		return false
+	}
+	os.MkdirAll(cfgDir, 0755)
+	os.Rename(filepath.Join(dataDir, "config.json"), filepath.Join(cfgDir, "config.json"))
+	os.Symlink(dataDir, legacy)
+	printInfo(fmt.Sprintf("Moved %s to %s (config: %s)", legacy, dataDir, cfgDir))
+	return true
+}
+
 func loadConfig() {
-	config = Config{
-		JupyterPort:   8888,
-		VSCodePort:    8080,
-		SSHPort:       7681,
-		DashboardPort: 3000,
-		PythonVersion: "3.11",
-		JupyterMode:   "lab",
-		WorkDir:       homeDir,
-		SMTPPort:      587,
-		LowPowerMode:  true,
-		NotifyOnStart: true,
+	config = defaultConfig()
+	if data, err := os.ReadFile(configPath); err == nil {
+		// Files from before schema_version existed don't have the key, so
+		// read it on its own instead of inheriting the default.
+		var onDisk struct {
+			SchemaVersion int `json:"schema_version"`
+		}
+		if json.Unmarshal(data, &config) == nil && json.Unmarshal(data, &onDisk) == nil && onDisk.SchemaVersion < configSchemaVersion {
+			config.SchemaVersion = onDisk.SchemaVersion
+			if _, err := migrateConfig(data); err != nil {
+				printWarning(fmt.Sprintf("Config not migrated to schema v%d, could not back it up: %v", configSchemaVersion, err))
+			}
+		}
+	}
+	applySecretEnv()
+}
+
+// configSchemaVersion is the config.json layout this build writes.
+// configMigrations[v] upgrades a config from version v to v+1.
+const configSchemaVersion = 1
+
+var configMigrations = []func(c *Config){
+	// 0 -> 1: fields older files could hold as zero values, which now fail validation.
+	func(c *Config) {
+		d := defaultConfig()
+		if c.StartupTimeout <= 0 {
+			c.StartupTimeout = d.StartupTimeout
+		}
+		if c.SMTPTimeout <= 0 {
+			c.SMTPTimeout = d.SMTPTimeout
+		}
+		if c.SMTPPort == 0 {
+			c.SMTPPort = d.SMTPPort
+		}
+		if c.JupyterMode == "" {
+			c.JupyterMode = d.JupyterMode
+		}
+		if c.PythonVersion == "" {
+			c.PythonVersion = d.PythonVersion
+		}
+	},
+}
+
+// migrateConfig brings config up to configSchemaVersion and rewrites
+// config.json, keeping the original as config.json.v<N>.bak. It returns
+// the backup path.
+func migrateConfig(orig []byte) (string, error) {
+	from := config.SchemaVersion
+	backup := fmt.Sprintf("%s.v%d.bak", configPath, from)
+	if err := os.WriteFile(backup, orig, 0600); err != nil {
+		return "", err
+	}
+	for v := from; v < configSchemaVersion; v++ {
+		configMigrations[v](&config)
+	}
+	config.SchemaVersion = configSchemaVersion
+	saveConfig()
+	return backup, nil
+}
+
+func defaultConfig() Config {
+	c := Config{
+		SchemaVersion:  configSchemaVersion,
+		JupyterPort:    8888,
+		VSCodePort:     8080,
+		SSHPort:        7681,
+		DashboardPort:  3000,
+		PythonVersion:  "3.11",
+		JupyterMode:    "lab",
+		WorkDir:        homeDir,
+		SMTPPort:       587,
+		SMTPTimeout:    15,
+		LowPowerMode:   true,
+		NotifyOnStart:  true,
+		StartupTimeout: 15,
+		InstallTimeout: 10,
+		JupyterEnabled: true,
+		VSCodeEnabled:  true,
+		SSHEnabled:     true,
+		TunnelEnabled:  true,
 	}
 
 	if u := os.Getenv("USER"); u != "" {
-		config.SSHUser = u
+		c.SSHUser = u
 	} else if u := os.Getenv("USERNAME"); u != "" {
-		config.SSHUser = u
+		c.SSHUser = u
 	} else {
-		config.SSHUser = "user"
+		c.SSHUser = "user"
 	}
 
 	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
-		config.EnableMPS = true
+		c.EnableMPS = true
 	}
 	if _, err := exec.LookPath("nvidia-smi"); err == nil {
-		config.EnableCUDA = true
-	}
-
-	if data, err := os.ReadFile(configPath); err == nil {
-		json.Unmarshal(data, &config)
+		c.EnableCUDA = true
 	}
+	return c
 }
 
 func saveConfig() {
-	data, _ := json.MarshalIndent(config, "", "  ")
+	c := config
+	// Secrets that came from the environment stay out of config.json unless
+	// they were changed since, e.g. by `config set`.
+	for key, orig := range secretOverrides {
+		if field := secretEnv[key](&c); *field == os.Getenv(key) {
+			*field = orig
+		}
+	}
+	data, _ := json.MarshalIndent(c, "", "  ")
 	os.WriteFile(configPath, data, 0600)
 }
 
+// secretEnv lists the variables that can supply secrets instead of config.json.
+var secretEnv = map[string]func(*Config) *string{
+	"CLOUDLAB_JUPYTER_PASSWORD": func(c *Config) *string { return &c.JupyterPassword },
+	"CLOUDLAB_VSCODE_PASSWORD":  func(c *Config) *string { return &c.VSCodePassword },
+	"CLOUDLAB_SSH_PASSWORD":     func(c *Config) *string { return &c.SSHPassword },
+	"CLOUDLAB_EMAIL_PASSWORD":   func(c *Config) *string { return &c.EmailPassword },
+}
+
+// secretOverrides remembers the config.json value of each overridden secret.
+var secretOverrides = map[string]string{}
+
+func applySecretEnv() {
+	secretOverrides = map[string]string{}
+	for key, field := range secretEnv {
+		if v := os.Getenv(key); v != "" {
+			secretOverrides[key] = *field(&config)
+			*field(&config) = v
+		}
+	}
+}
+
+// loadEnvFile reads KEY=VALUE lines into the environment. Blank lines,
+// comments and an "export " prefix are allowed; variables already set in
+// the real environment win.
+func loadEnvFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, val)
+		}
+	}
+	return nil
+}
+
 func showConfig() {
 	fmt.Println(getLogo())
 	printHeader("📋 CONFIGURATION")
 	fmt.Printf("  %-20s : %s%d%s\n", "jupyter_port", BrightCyan, config.JupyterPort, Reset)
+	if config.JupyterSocket != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "jupyter_socket", BrightCyan, config.JupyterSocket, Reset)
+	}
+	fmt.Printf("  %-20s : %s%s%s\n", "bind_address", BrightCyan, bindAddress(), Reset)
 	fmt.Printf("  %-20s : %s%d%s\n", "vscode_port", BrightCyan, config.VSCodePort, Reset)
 	fmt.Printf("  %-20s : %s%d%s\n", "ssh_port", BrightCyan, config.SSHPort, Reset)
 	fmt.Printf("  %-20s : %s%d%s\n", "dashboard_port", BrightCyan, config.DashboardPort, Reset)
+	if config.ViewerPassword != "" {
+		fmt.Printf("  %-20s : %s%d%s\n", "viewer_port", BrightCyan, config.ViewerPort, Reset)
+	}
 	fmt.Printf("  %-20s : %s%s%s\n", "jupyter_mode", BrightGreen, config.JupyterMode, Reset)
 	fmt.Printf("  %-20s : %s%s%s\n", "python_version", BrightYellow, config.PythonVersion, Reset)
+	if config.PythonExe != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "python_executable", BrightYellow, config.PythonExe, Reset)
+	}
 	fmt.Printf("  %-20s : %s%s%s\n", "working_directory", BrightBlue, config.WorkDir, Reset)
 	fmt.Printf("  %-20s : %s%s%s\n", "ssh_user", BrightMagenta, config.SSHUser, Reset)
+	if config.SSHHost != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "ssh_host", BrightMagenta, config.SSHHost, Reset)
+	}
 	if config.Email != "" {
 		fmt.Printf("  %-20s : %s%s%s\n", "email", BrightMagenta, config.Email, Reset)
 	}
+	if config.InstanceName != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "instance_name", BrightMagenta, config.InstanceName, Reset)
+	}
 	fmt.Printf("  %-20s : %s%v%s\n", "enable_mps", boolColor(config.EnableMPS), config.EnableMPS, Reset)
 	fmt.Printf("  %-20s : %s%v%s\n", "enable_cuda", boolColor(config.EnableCUDA), config.EnableCUDA, Reset)
+	if config.UseSysJupyter {
+		fmt.Printf("  %-20s : %s%v%s\n", "use_system_jupyter", BrightGreen, true, Reset)
+	}
+	if config.UseSysVSCode {
+		fmt.Printf("  %-20s : %s%v%s\n", "use_system_vscode", BrightGreen, true, Reset)
+	}
+	if config.IdleTimeout > 0 {
+		fmt.Printf("  %-20s : %s%d min%s\n", "idle_timeout", BrightCyan, config.IdleTimeout, Reset)
+	}
+	fmt.Printf("  %-20s : %s%ds%s\n", "startup_timeout", BrightCyan, config.StartupTimeout, Reset)
+	if config.Email != "" {
+		fmt.Printf("  %-20s : %s%ds%s\n", "smtp_timeout", BrightCyan, config.SMTPTimeout, Reset)
+	}
+	if config.InstallTimeout > 0 {
+		fmt.Printf("  %-20s : %s%d min%s\n", "install_timeout", BrightCyan, config.InstallTimeout, Reset)
+	} else {
+		fmt.Printf("  %-20s : %soff%s\n", "install_timeout", BrightCyan, Reset)
+	}
+	if config.TunnelProtocol != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "tunnel_protocol", BrightCyan, config.TunnelProtocol, Reset)
+	}
+	if config.TunnelRegion != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "tunnel_region", BrightCyan, config.TunnelRegion, Reset)
+	}
+	if config.TunnelPattern != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "tunnel_url_pattern", BrightCyan, config.TunnelPattern, Reset)
+	}
+	if config.TunnelGrace > 0 {
+		fmt.Printf("  %-20s : %s%ds%s\n", "tunnel_grace_period", BrightCyan, config.TunnelGrace, Reset)
+	}
+	if config.TerminalBackend != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "terminal_backend", BrightCyan, config.TerminalBackend, Reset)
+	}
+	if config.StartMode != "" {
+		fmt.Printf("  %-20s : %s%s%s\n", "default_start_mode", BrightCyan, config.StartMode, Reset)
+	}
+	for _, key := range []string{"jupyter_extra_args", "vscode_extra_args", "ttyd_extra_args"} {
+		if extra := extraArgsKeys()[key]; len(*extra) > 0 {
+			fmt.Printf("  %-20s : %s%q%s\n", key, BrightCyan, *extra, Reset)
+		}
+	}
 	fmt.Println()
 }
 
+func extraArgsKeys() map[string]*[]string {
+	return map[string]*[]string{
+		"jupyter_extra_args": &config.JupyterArgs,
+		"vscode_extra_args":  &config.VSCodeArgs,
+		"ttyd_extra_args":    &config.TerminalArgs,
+	}
+}
+
+// splitArgs splits s into arguments the way a POSIX shell would, honouring
+// single quotes, double quotes and backslash escapes but nothing else.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
 func handleConfig(args []string) {
+	switch args[0] {
+	case "path":
+		fmt.Println(configPath)
+		return
+	case "edit":
+		editConfig()
+		return
+	}
 	if args[0] == "reset" {
-		os.Remove(configPath)
-		loadConfig()
+		resetConfig(hasFlag(args, "--yes", "-y"))
+		return
+	}
+	if args[0] == "migrate" {
+		runConfigMigrate()
+		return
+	}
+	if args[0] == "unset" && len(args) >= 2 {
+		unsetConfig(args[1])
+		return
+	}
+	if (args[0] == "enable" || args[0] == "disable") && len(args) >= 2 {
+		key := args[1]
+		b, ok := boolConfigKeys()[key]
+		if !ok {
+			printErrorCode(codeInvalid, fmt.Sprintf("%s is not a boolean setting (one of: %s)", key, strings.Join(boolConfigKeyNames(), ", ")))
+			return
+		}
+		*b = args[0] == "enable"
 		saveConfig()
-		printSuccess("Configuration reset!")
+		printSuccess(fmt.Sprintf("Set %s = %v", key, *b))
+		warnInsecureSMTP(key)
 		return
 	}
 	if args[0] == "set" && len(args) >= 3 {
+		strict := hasFlag(args, "--strict")
+		args = removeArg(args, "--strict")
 		key, val := args[1], strings.Join(args[2:], " ")
+		if b, ok := boolConfigKeys()[key]; ok {
+			v, err := parseBool(val)
+			if err != nil {
+				printErrorCode(errCode(err), err.Error())
+				return
+			}
+			*b = v
+			saveConfig()
+			printSuccess(fmt.Sprintf("Set %s = %v", key, v))
+			warnInsecureSMTP(key)
+			return
+		}
 		switch key {
 		case "jupyter_port":
-			config.JupyterPort, _ = strconv.Atoi(val)
+			if !setPort(val, &config.JupyterPort) {
+				return
+			}
+		case "bind_address":
+			ip := net.ParseIP(strings.Trim(val, "[]"))
+			if ip == nil {
+				printErrorCode(codeInvalid, "bind_address must be an IPv4 or IPv6 address, e.g. 0.0.0.0, ::, 127.0.0.1 or ::1")
+				return
+			}
+			val = ip.String()
+			config.BindAddress = val
+		case "jupyter_socket":
+			if val != "" && val != "none" {
+				val = expandPath(val)
+			} else {
+				val = ""
+			}
+			config.JupyterSocket = val
+			if !configureJupyter() {
+				return
+			}
 		case "vscode_port":
-			config.VSCodePort, _ = strconv.Atoi(val)
+			if !setPort(val, &config.VSCodePort) {
+				return
+			}
 		case "ssh_port":
-			config.SSHPort, _ = strconv.Atoi(val)
+			if !setPort(val, &config.SSHPort) {
+				return
+			}
 		case "dashboard_port":
-			config.DashboardPort, _ = strconv.Atoi(val)
+			if !setPort(val, &config.DashboardPort) {
+				return
+			}
 		case "jupyter_mode":
+			if val != "lab" && val != "notebook" {
+				printErrorCode(codeInvalid, "jupyter_mode must be one of: lab, notebook")
+				return
+			}
 			config.JupyterMode = val
 		case "python_version":
 			config.PythonVersion = val
 		case "working_directory":
-			config.WorkDir = val
+			dir := expandPath(val)
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				printErrorCode(codeNotFound, "Directory not found: "+dir)
+				return
+			}
+			config.WorkDir = dir
 		case "jupyter_password":
+			if !checkPassword(key, val) {
+				return
+			}
 			config.JupyterPassword = val
 		case "vscode_password":
+			if !checkPassword(key, val) {
+				return
+			}
 			config.VSCodePassword = val
+		case "viewer_password":
+			if val == "none" {
+				val = ""
+			} else if !checkPassword(key, val) {
+				return
+			} else if val == config.JupyterPassword {
+				printErrorCode(codeInvalid, "viewer_password must differ from jupyter_password, or viewers get full access")
+				return
+			}
+			config.ViewerPassword = val
+			if isRunning("viewer") {
+				printInfo("Restart the viewer to apply: cloudlab restart viewer")
+			}
+		case "viewer_port":
+			if !setPort(val, &config.ViewerPort) {
+				return
+			}
 		case "ssh_user":
 			config.SSHUser = val
 		case "ssh_password":
+			if !checkPassword(key, val) {
+				return
+			}
 			config.SSHPassword = val
+		case "ssh_host":
+			host, port := splitSSHHost(val)
+			if isLocalHost(host) {
+				val = ""
+			} else if !hostnameRe.MatchString(host) && net.ParseIP(host) == nil {
+				printErrorCode(codeInvalid, fmt.Sprintf("invalid ssh_host: %q (use host, host:port or localhost)", val))
+				return
+			} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				printErrorCode(codeInvalid, "ssh_host port must be between 1 and 65535")
+				return
+			}
+			config.SSHHost = val
+			if val != "" {
+				checkSSHHost()
+			}
 		case "email_address":
 			config.Email = val
+		case "instance_name":
+			config.InstanceName = strings.TrimSpace(val)
 		case "email_app_password":
 			config.EmailPassword = val
+		case "smtp_password_command":
+			if val == "none" {
+				val = ""
+			}
+			config.SMTPPasswordCmd = val
+			if val != "" && config.EmailPassword != "" {
+				printInfo("smtp_password_command takes precedence; clear the stored one with: cloudlab config set email_app_password \"\"")
+			}
 		case "smtp_server":
-			config.SMTPServer = val
-		case "notify_on_start":
-			config.NotifyOnStart = val == "true"
-		default:
-			printError("Unknown key: " + key)
-			return
-		}
-		saveConfig()
-		printSuccess(fmt.Sprintf("Set %s = %s", key, val))
+			host, err := validateSMTPServer(val, strict)
+			if err != nil {
+				printErrorCode(errCode(err), err.Error())
+				return
+			}
+			config.SMTPServer = host
+		case "smtp_port":
+			p, err := strconv.Atoi(strings.TrimSpace(val))
+			if err != nil || p < 1 || p > 65535 {
+				printErrorCode(codeInvalid, "Invalid port: "+val+" (must be 1-65535)")
+				return
+			}
+			config.SMTPPort = p
+			warnSMTPPort(p)
+		case "smtp_timeout":
+			n, err := strconv.Atoi(strings.TrimSuffix(val, "s"))
+			if err != nil || n <= 0 {
+				printErrorCode(codeInvalid, "smtp_timeout must be a positive number of seconds")
+				return
+			}
+			config.SMTPTimeout = n
+		case "smtp_ca_cert", "smtp_client_cert", "smtp_client_key":
+			if val == "none" || val == "" {
+				val = ""
+			} else {
+				val = expandPath(val)
+				if _, err := os.Stat(val); err != nil {
+					printErrorCode(codeNotFound, "File not found: "+val)
+					return
+				}
+			}
+			switch key {
+			case "smtp_ca_cert":
+				config.SMTPCACert = val
+			case "smtp_client_cert":
+				config.SMTPClientCert = val
+			default:
+				config.SMTPClientKey = val
+			}
+			if _, err := smtpTLSConfig(); err != nil {
+				if key == "smtp_ca_cert" {
+					config.SMTPCACert = ""
+					printErrorCode(errCode(err), err.Error())
+					return
+				}
+				// The cert and key are set one at a time, so only warn.
+				printWarning(err.Error())
+			}
+		case "idle_timeout":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				printErrorCode(codeInvalid, "idle_timeout must be a number of minutes (0 disables)")
+				return
+			}
+			config.IdleTimeout = n
+		case "startup_timeout":
+			n, err := strconv.Atoi(strings.TrimSuffix(val, "s"))
+			if err != nil || n <= 0 {
+				printErrorCode(codeInvalid, "startup_timeout must be a positive number of seconds")
+				return
+			}
+			config.StartupTimeout = n
+		case "install_timeout":
+			d, err := parseMinutes(val)
+			if err != nil || d < 0 {
+				printErrorCode(codeInvalid, "install_timeout must be a number of minutes (0 disables)")
+				return
+			}
+			config.InstallTimeout = int(d.Round(time.Minute) / time.Minute)
+		case "tunnel_protocol":
+			if val != "quic" && val != "http2" && val != "auto" {
+				printErrorCode(codeInvalid, "tunnel_protocol must be one of: quic, http2, auto")
+				return
+			}
+			config.TunnelProtocol = val
+		case "tunnel_grace_period":
+			n, err := strconv.Atoi(strings.TrimSuffix(val, "s"))
+			if err != nil || n < 0 {
+				printErrorCode(codeInvalid, "tunnel_grace_period must be a number of seconds (0 stops tunnels immediately)")
+				return
+			}
+			config.TunnelGrace = n
+		case "tunnel_region":
+			config.TunnelRegion = val
+		case "tunnel_url_pattern":
+			if val == "none" {
+				val = ""
+			} else if _, err := regexp.Compile(val); err != nil {
+				printErrorCode(errCode(err), "tunnel_url_pattern is not a valid regular expression: "+err.Error())
+				return
+			}
+			config.TunnelPattern = val
+		case "jupyter_extra_args", "vscode_extra_args", "ttyd_extra_args":
+			extra, err := splitArgs(val)
+			if err != nil {
+				printErrorCode(errCode(err), key+": "+err.Error())
+				return
+			}
+			*extraArgsKeys()[key] = extra
+		case "offline_dir":
+			if val == "none" {
+				val = ""
+			} else {
+				val = expandPath(val)
+				if info, err := os.Stat(val); err != nil || !info.IsDir() {
+					printErrorCode(codeNotFound, "Directory not found: "+val)
+					return
+				}
+			}
+			config.OfflineDir = val
+		case "python_executable":
+			if val == "none" {
+				val = ""
+			} else {
+				val = expandPath(val)
+				ver, err := checkPython(val)
+				if err != nil {
+					printErrorCode(errCode(err), err.Error())
+					return
+				}
+				printInfo("Found Python " + ver)
+			}
+			config.PythonExe = val
+		case "run_as_user":
+			if val == "none" {
+				val = ""
+			}
+			if val != "" {
+				u, err := lookupRunAs(val)
+				if err != nil {
+					printErrorCode(errCode(err), "run_as_user: "+err.Error())
+					return
+				}
+				printInfo(fmt.Sprintf("Services will run as %s (uid %d); it needs read access to %s", u.name, u.uid, cloudlabDir))
+			}
+			config.RunAsUser = val
+		case "terminal_backend":
+			if val != "ttyd" && val != "gotty" && val != "builtin" {
+				printErrorCode(codeInvalid, "terminal_backend must be one of: ttyd, gotty, builtin")
+				return
+			}
+			config.TerminalBackend = val
+		case "default_start_mode":
+			if val != "detached" && val != "foreground" {
+				printErrorCode(codeInvalid, "default_start_mode must be one of: detached, foreground")
+				return
+			}
+			config.StartMode = val
+		default:
+			printErrorCode(codeInvalid, "Unknown key: "+key)
+			return
+		}
+		saveConfig()
+		printSuccess(fmt.Sprintf("Set %s = %s", key, val))
+	}
+}
+
+// unsetConfig puts one key back to its default, then redoes whatever
+// `config set` would have for it. Passwords get a fresh random one rather
+// than none, as setup does.
+func unsetConfig(key string) {
+	cv := reflect.ValueOf(&config).Elem()
+	dv := reflect.ValueOf(defaultConfig())
+	field := -1
+	for i := 0; i < cv.NumField(); i++ {
+		if name, _, _ := strings.Cut(cv.Type().Field(i).Tag.Get("json"), ","); name == key {
+			field = i
+			break
+		}
+	}
+	if field < 0 {
+		printErrorCode(codeInvalid, "Unknown key: "+key)
+		return
+	}
+	cv.Field(field).Set(dv.Field(field))
+
+	switch key {
+	case "jupyter_password":
+		config.JupyterPassword = genToken(16)
+		if !configureJupyter() {
+			return
+		}
+		printInfo("New Jupyter password: " + config.JupyterPassword)
+	case "vscode_password":
+		config.VSCodePassword = genToken(16)
+		printInfo("New VS Code password: " + config.VSCodePassword)
+		configureVSCode()
+	case "jupyter_socket":
+		if !configureJupyter() {
+			return
+		}
+	}
+	saveConfig()
+	if val := fmt.Sprint(cv.Field(field).Interface()); strings.HasSuffix(key, "password") || val == "" {
+		printSuccess("Unset " + key)
+	} else {
+		printSuccess(fmt.Sprintf("Unset %s (now %s)", key, val))
+	}
+}
+
+func setPort(val string, port *int) bool {
+	p, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || p < 0 || p > 65535 {
+		printErrorCode(codeInvalid, "Invalid port: "+val+" (must be 1-65535, or 0 to pick a free port)")
+		return false
+	}
+	*port = p
+	if p == 0 {
+		printInfo("A free port will be picked and saved on next start")
+	} else if p < 1024 && runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		printWarning(fmt.Sprintf("Port %d is privileged; binding it requires root, so the service will fail to start as this user", p))
+	}
+	return true
+}
+
+func assignPort(label string, port *int) bool {
+	if *port != 0 && !autoPortFlag {
+		return true
+	}
+	p, err := freePort()
+	if err != nil {
+		printErrorCode(errCode(err), "Could not find a free port: "+err.Error())
+		return false
+	}
+	*port = p
+	saveConfig()
+	printInfo(fmt.Sprintf("Auto-assigned port %d to %s", p, label))
+	return true
+}
+
+// jupyterBindArgs, vscodeBindArg and terminalBindArgs turn bind_address
+// into each program's own listen flags.
+func jupyterBindArgs(port int) []string {
+	return []string{"--ip=" + bindAddress(), fmt.Sprintf("--port=%d", port)}
+}
+
+func vscodeBindArg(port int) string {
+	return "--bind-addr=" + net.JoinHostPort(bindAddress(), strconv.Itoa(port))
+}
+
+func terminalBindArgs(backend string, port int) []string {
+	ip := net.ParseIP(bindAddress())
+	specific := ip != nil && !ip.IsUnspecified()
+	switch backend {
+	case "builtin":
+		return []string{webTerminalCmd, "--port", strconv.Itoa(port), "--bind", bindAddress()}
+	case "gotty":
+		args := []string{"-w", "-p", strconv.Itoa(port)}
+		if specific {
+			args = append(args, "--address", ip.String())
+		}
+		return args
+	}
+	args := []string{"--port", strconv.Itoa(port), "--writable"}
+	if specific {
+		args = append(args, "--interface", ip.String())
+	}
+	return args
+}
+
+// checkPortAvailable reports whether port can be bound. key is the config
+// key that sets the port, or a named terminal's ssh_<name>.
+func checkPortAvailable(key string, port int) bool {
+	addr := fmt.Sprintf(":%d", port)
+	if ip := net.ParseIP(bindAddress()); ip != nil && !ip.IsUnspecified() {
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+	l, err := net.Listen("tcp", addr)
+	if err == nil {
+		l.Close()
+		return true
+	}
+	owner, fix := "", "cloudlab config set "+key+" <port>"
+	if t := findTerminal(key); t != nil {
+		owner, fix = " (terminal "+t.Name+")", "cloudlab ssh start "+t.Name+" --port <port>"
+	}
+	if errors.Is(err, os.ErrPermission) {
+		printErrorCode(codePermission, fmt.Sprintf("Permission denied binding port %d%s (ports below 1024 require root). Run: %s", port, owner, fix))
+	} else {
+		printErrorCode(codePortInUse, fmt.Sprintf("Port %d%s is not available: %v", port, owner, err))
+	}
+	return false
+}
+
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+func validateSMTPServer(host string, strict bool) (string, error) {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return "", fmt.Errorf("smtp_server must not be empty")
+	}
+	if !hostnameRe.MatchString(host) {
+		return "", fmt.Errorf("invalid smtp_server hostname: %q", host)
+	}
+	if strict {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", fmt.Errorf("smtp_server %s does not resolve: %v", host, err)
+		}
+	}
+	return host, nil
+}
+
+func warnInsecureSMTP(key string) {
+	if key == "smtp_insecure_skip_verify" && config.SMTPInsecure {
+		printWarning("SMTP certificates will not be verified; anyone on the network path can read your email password. Prefer smtp_ca_cert for a private CA.")
+	}
+}
+
+// smtpTLSConfig builds the STARTTLS config, adding a private CA bundle and a
+// client certificate when configured.
+func smtpTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: config.SMTPServer, InsecureSkipVerify: config.SMTPInsecure}
+	if config.SMTPCACert != "" {
+		pem, err := os.ReadFile(config.SMTPCACert)
+		if err != nil {
+			return nil, fmt.Errorf("smtp_ca_cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("smtp_ca_cert: no PEM certificates in %s", config.SMTPCACert)
+		}
+		cfg.RootCAs = pool
+	}
+	if config.SMTPClientCert != "" || config.SMTPClientKey != "" {
+		if config.SMTPClientCert == "" || config.SMTPClientKey == "" {
+			return nil, fmt.Errorf("smtp_client_cert and smtp_client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.SMTPClientCert, config.SMTPClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("smtp client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+const minPasswordLength = 10
+
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "passw0rd": true, "123456": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwerty": true, "qwerty123": true, "qwertyuiop": true,
+	"abc123": true, "111111": true, "letmein": true, "welcome": true, "welcome1": true,
+	"admin": true, "admin123": true, "root": true, "toor": true, "changeme": true,
+	"iloveyou": true, "monkey": true, "dragon": true, "football": true, "baseball": true,
+	"sunshine": true, "princess": true, "hunter2": true, "trustno1": true, "secret": true,
+	"jupyter": true, "notebook": true, "cloudlab": true, "vscode": true, "ubuntu": true,
+}
+
+// weakPassword says why a human-chosen password is too weak to put behind a
+// public tunnel, or returns "" if it looks fine.
+func weakPassword(pw string) string {
+	lower := strings.ToLower(pw)
+	switch {
+	case commonPasswords[lower]:
+		return "it is one of the most common passwords"
+	case len(pw) < minPasswordLength:
+		return fmt.Sprintf("it is shorter than %d characters", minPasswordLength)
+	case strings.Count(pw, pw[:1]) == len(pw):
+		return "it repeats a single character"
+	case lower == strings.ToLower(config.SSHUser):
+		return "it is the same as the username"
+	}
+	return ""
+}
+
+// checkPassword warns about a weak password, or rejects it when
+// strict_passwords is on. Generated passwords don't go through here.
+func checkPassword(key, pw string) bool {
+	why := weakPassword(pw)
+	if why == "" {
+		return true
+	}
+	if config.StrictPasswords {
+		printErrorCode(codeInvalid, fmt.Sprintf("%s rejected: %s (strict_passwords is on)", key, why))
+		return false
+	}
+	printWarning(fmt.Sprintf("Weak %s: %s. Anyone who finds a tunnel URL can try to guess it.", key, why))
+	return true
+}
+
+func warnSMTPPort(port int) {
+	switch port {
+	case 587:
+	case 465:
+		printWarning("Port 465 expects implicit TLS, but CloudLab connects with STARTTLS; most providers accept STARTTLS on 587")
+	case 25:
+		printWarning("Port 25 is often blocked by cloud providers and ISPs; 587 with STARTTLS is usually more reliable")
+	default:
+		printWarning(fmt.Sprintf("Port %d is not a standard SMTP submission port; CloudLab will use STARTTLS", port))
+	}
+}
+
+// runConfigMigrate is `config migrate`. loadConfig already migrates old
+// files, so this mostly reports the version, or retries a failed rewrite.
+func runConfigMigrate() {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		printInfo("No config file yet; it will be written at schema v" + strconv.Itoa(configSchemaVersion))
+		return
+	}
+	var onDisk struct {
+		SchemaVersion int `json:"schema_version"`
 	}
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		printErrorCode(errCode(err), "config.json is not valid JSON: "+err.Error())
+		exit(1)
+		return
+	}
+	setJSONData(map[string]int{"from": onDisk.SchemaVersion, "to": configSchemaVersion})
+	switch {
+	case onDisk.SchemaVersion > configSchemaVersion:
+		printWarning(fmt.Sprintf("config.json is schema v%d, newer than this CloudLab (v%d); upgrade CloudLab instead", onDisk.SchemaVersion, configSchemaVersion))
+	case onDisk.SchemaVersion == configSchemaVersion:
+		printSuccess(fmt.Sprintf("Config is already at schema v%d", configSchemaVersion))
+	default:
+		config.SchemaVersion = onDisk.SchemaVersion
+		backup, err := migrateConfig(data)
+		if err != nil {
+			printErrorCode(errCode(err), "Could not back up config: "+err.Error())
+			exit(1)
+			return
+		}
+		printSuccess(fmt.Sprintf("Config migrated from schema v%d to v%d (previous version: %s)", onDisk.SchemaVersion, configSchemaVersion, backup))
+	}
+}
+
+func resetConfig(yes bool) {
+	data, err := os.ReadFile(configPath)
+	if err == nil {
+		if !yes {
+			fmt.Printf("\n%sReset all settings to defaults?%s Passwords, ports and tunnel settings are lost. [y/N]: ", BrightYellow, Reset)
+			if strings.ToLower(readLine(bufio.NewReader(os.Stdin))) != "y" {
+				printInfo("Cancelled")
+				return
+			}
+		}
+		backup := fmt.Sprintf("%s.%s.bak", configPath, time.Now().Format("20060102-150405"))
+		if err := os.WriteFile(backup, data, 0600); err != nil {
+			printErrorCode(errCode(err), "Could not back up config: "+err.Error())
+			return
+		}
+		printInfo("Previous config saved to " + backup)
+	}
+	os.Remove(configPath)
+	loadConfig()
+	saveConfig()
+	printSuccess("Configuration reset!")
+}
+
+// runAsUser is the unprivileged account services are started as when
+// run_as_user is set; see lookupRunAs.
+type runAsUser struct {
+	name     string
+	home     string
+	uid, gid uint32
+	groups   []uint32
+}
+
+// dropPrivileges applies run_as_user to a service command. It returns the
+// user (nil when unset) and false, after printing why, if the switch isn't
+// possible.
+func dropPrivileges(cmd *exec.Cmd) (*runAsUser, bool) {
+	if config.RunAsUser == "" {
+		return nil, true
+	}
+	u, err := lookupRunAs(config.RunAsUser)
+	if err != nil {
+		printErrorCode(errCode(err), "run_as_user: "+err.Error())
+		return nil, false
+	}
+	u.apply(cmd)
+	return u, true
+}
+
+// configDir is a directory of ours in the run-as user's home for the
+// config its services read. Their own ~/.jupyter and code-server config
+// stay untouched, and they don't need access to our data dir.
+func (u *runAsUser) configDir(name string) (string, error) {
+	dir := filepath.Join(u.home, ".cloudlab", name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for d := dir; d != u.home && strings.HasPrefix(d, u.home); d = filepath.Dir(d) {
+		if err := os.Chown(d, int(u.uid), int(u.gid)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// writeFile writes a private file the run-as user owns; with no run-as
+// user (u == nil) it's a plain os.WriteFile.
+func (u *runAsUser) writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	if u == nil {
+		return nil
+	}
+	return os.Chown(path, int(u.uid), int(u.gid))
+}
+
+// copyConfigTo copies config files CloudLab wrote under our home into
+// u.configDir(name) and returns that directory. Services must not start
+// without them, so false means the error has been printed.
+func (u *runAsUser) copyConfigTo(name string, srcs ...string) (string, bool) {
+	dir, err := u.configDir(name)
+	for _, src := range srcs {
+		if err != nil {
+			break
+		}
+		data, rerr := os.ReadFile(src)
+		if rerr != nil {
+			continue
+		}
+		err = u.writeFile(filepath.Join(dir, filepath.Base(src)), data)
+	}
+	if err != nil {
+		printErrorCode(errCode(err), "Could not write "+name+" config for "+u.name+": "+err.Error())
+		return "", false
+	}
+	return dir, true
+}
+
+// validateConfig catches the mistakes a hand edit can make that `config set`
+// would have refused.
+func validateConfig(c *Config) error {
+	ports := map[string]int{"jupyter_port": c.JupyterPort, "vscode_port": c.VSCodePort, "ssh_port": c.SSHPort, "dashboard_port": c.DashboardPort, "smtp_port": c.SMTPPort, "viewer_port": c.ViewerPort}
+	for _, key := range []string{"jupyter_port", "vscode_port", "ssh_port", "dashboard_port", "smtp_port", "viewer_port"} {
+		if p := ports[key]; p < 0 || p > 65535 {
+			return fmt.Errorf("%s must be between 0 and 65535, got %d", key, p)
+		}
+	}
+	if c.JupyterMode != "lab" && c.JupyterMode != "notebook" {
+		return fmt.Errorf("jupyter_mode must be lab or notebook, got %q", c.JupyterMode)
+	}
+	if c.BindAddress != "" && net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("bind_address is not an IP address: %q", c.BindAddress)
+	}
+	if c.TerminalBackend != "" && c.TerminalBackend != "ttyd" && c.TerminalBackend != "gotty" && c.TerminalBackend != "builtin" {
+		return fmt.Errorf("terminal_backend must be ttyd, gotty or builtin, got %q", c.TerminalBackend)
+	}
+	if c.StartMode != "" && c.StartMode != "detached" && c.StartMode != "foreground" {
+		return fmt.Errorf("default_start_mode must be detached or foreground, got %q", c.StartMode)
+	}
+	if c.StartupTimeout <= 0 {
+		return fmt.Errorf("startup_timeout must be a positive number of seconds")
+	}
+	if _, err := regexp.Compile(c.TunnelPattern); err != nil {
+		return fmt.Errorf("tunnel_url_pattern is not a valid regular expression: %v", err)
+	}
+	if c.SMTPTimeout <= 0 {
+		return fmt.Errorf("smtp_timeout must be a positive number of seconds")
+	}
+	if c.IdleTimeout < 0 || c.InstallTimeout < 0 {
+		return fmt.Errorf("idle_timeout and install_timeout can't be negative")
+	}
+	return nil
+}
+
+// editConfig opens a copy of the config in $EDITOR and only replaces the real
+// file once the copy parses and validates; the previous version is kept as
+// config.json.bak.
+func editConfig() {
+	if outputJSON {
+		printErrorCode(codeUsage, "config edit opens an editor; use config set with --output json")
+		exit(2)
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	editorArgs, err := splitArgs(editor)
+	if err != nil || len(editorArgs) == 0 {
+		printErrorCode(codeInvalid, "Can't parse $EDITOR: "+editor)
+		return
+	}
+
+	if _, err := os.Stat(configPath); err != nil {
+		saveConfig()
+	}
+	orig, err := os.ReadFile(configPath)
+	if err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	tmp := configPath + ".edit"
+	if err := os.WriteFile(tmp, orig, 0600); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	defer os.Remove(tmp)
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		cmd := exec.Command(editorArgs[0], append(editorArgs[1:], tmp)...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			printErrorCode(errCode(err), "Editor failed: "+err.Error())
+			return
+		}
+		data, err := os.ReadFile(tmp)
+		if err != nil {
+			printErrorCode(errCode(err), "Failed: "+err.Error())
+			return
+		}
+		if bytes.Equal(data, orig) {
+			printInfo("No changes")
+			return
+		}
+
+		edited := config
+		if err = json.Unmarshal(data, &edited); err == nil {
+			err = validateConfig(&edited)
+		}
+		if err == nil {
+			if err := os.WriteFile(configPath+".bak", orig, 0600); err != nil {
+				printErrorCode(errCode(err), "Could not write backup: "+err.Error())
+				return
+			}
+			if err := os.WriteFile(configPath, data, 0600); err != nil {
+				printErrorCode(errCode(err), "Failed: "+err.Error())
+				return
+			}
+			loadConfig()
+			printSuccess("Config saved (previous version: " + configPath + ".bak)")
+			return
+		}
+
+		printErrorCode(errCode(err), "Invalid config: "+err.Error())
+		fmt.Printf("Edit again? [Y/n]: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil || strings.ToLower(strings.TrimSpace(answer)) == "n" {
+			printInfo("Discarded changes; " + configPath + " is unchanged")
+			return
+		}
+	}
+}
+
+func boolConfigKeys() map[string]*bool {
+	return map[string]*bool{
+		"enable_mps":                &config.EnableMPS,
+		"enable_cuda":               &config.EnableCUDA,
+		"low_power_mode":            &config.LowPowerMode,
+		"notify_on_start":           &config.NotifyOnStart,
+		"desktop_notify":            &config.DesktopNotify,
+		"idle_notify":               &config.IdleNotify,
+		"use_system_jupyter":        &config.UseSysJupyter,
+		"use_system_vscode":         &config.UseSysVSCode,
+		"smtp_insecure_skip_verify": &config.SMTPInsecure,
+		"jupyter_enabled":           &config.JupyterEnabled,
+		"vscode_enabled":            &config.VSCodeEnabled,
+		"ssh_enabled":               &config.SSHEnabled,
+		"tunnel_enabled":            &config.TunnelEnabled,
+		"strict_passwords":          &config.StrictPasswords,
+	}
+}
+
+func boolConfigKeyNames() []string {
+	var names []string
+	for k := range boolConfigKeys() {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true", "yes", "on", "1", "y":
+		return true, nil
+	case "false", "no", "off", "0", "n":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean: %q (use true/false)", s)
 }
 
 func boolColor(b bool) string {
@@ -436,8 +2009,9 @@ func initSetup() {
 	// Working directory
 	fmt.Printf("\n%s[1/9]%s Working directory [%s]: ", BrightCyan, Reset, config.WorkDir)
 	if input := readLine(reader); input != "" {
-		os.MkdirAll(input, 0755)
-		config.WorkDir = input
+		dir := expandPath(input)
+		os.MkdirAll(dir, 0755)
+		config.WorkDir = dir
 	}
 
 	// Jupyter mode
@@ -449,27 +2023,27 @@ func initSetup() {
 	// Ports
 	fmt.Printf("%s[3/9]%s Jupyter port [%d]: ", BrightCyan, Reset, config.JupyterPort)
 	if input := readLine(reader); input != "" {
-		config.JupyterPort, _ = strconv.Atoi(input)
+		setPort(input, &config.JupyterPort)
 	}
 
 	fmt.Printf("%s[4/9]%s VS Code port [%d]: ", BrightCyan, Reset, config.VSCodePort)
 	if input := readLine(reader); input != "" {
-		config.VSCodePort, _ = strconv.Atoi(input)
+		setPort(input, &config.VSCodePort)
 	}
 
 	fmt.Printf("%s[5/9]%s SSH Terminal port [%d]: ", BrightCyan, Reset, config.SSHPort)
 	if input := readLine(reader); input != "" {
-		config.SSHPort, _ = strconv.Atoi(input)
+		setPort(input, &config.SSHPort)
 	}
 
 	fmt.Printf("%s[6/9]%s Dashboard port [%d]: ", BrightCyan, Reset, config.DashboardPort)
 	if input := readLine(reader); input != "" {
-		config.DashboardPort, _ = strconv.Atoi(input)
+		setPort(input, &config.DashboardPort)
 	}
 
 	// Passwords
 	fmt.Printf("%s[7/9]%s Jupyter password (Enter=auto): ", BrightCyan, Reset)
-	if input := readLine(reader); input != "" {
+	if input := readLine(reader); input != "" && checkPassword("jupyter_password", input) {
 		config.JupyterPassword = input
 	} else {
 		config.JupyterPassword = genToken(16)
@@ -477,7 +2051,7 @@ func initSetup() {
 	}
 
 	fmt.Printf("%s[8/9]%s VS Code password (Enter=auto): ", BrightCyan, Reset)
-	if input := readLine(reader); input != "" {
+	if input := readLine(reader); input != "" && checkPassword("vscode_password", input) {
 		config.VSCodePassword = input
 	} else {
 		config.VSCodePassword = genToken(16)
@@ -504,6 +2078,10 @@ func initSetup() {
 	if !config.EnableMPS && !config.EnableCUDA {
 		printInfo("CPU mode")
 	}
+	if isWSL() {
+		printSuccess("WSL detected")
+		printWSLNote()
+	}
 
 	saveConfig()
 	printSuccess("Configuration saved!")
@@ -529,69 +2107,367 @@ func detectSMTP(email string) {
 }
 
 func readLine(r *bufio.Reader) string {
+	if outputJSON {
+		// The question would only end up in the captured output.
+		printErrorCode(codeUsage, "Can't prompt with --output json; pass --yes or run without --json")
+		exit(2)
+	}
 	s, _ := r.ReadString('\n')
 	return strings.TrimSpace(s)
 }
 
 // ==================== Install ====================
 
-func installAll() {
-	printHeader("📦 INSTALLING")
-	installUV()
-	installJupyter()
-	installVSCode()
-	installTTYD()
-	installCloudflared()
-	createDashboardFiles()
-	printSuccess("All components installed!")
+const (
+	gigabyte           = 1 << 30
+	jupyterInstallSize = 1 * gigabyte
+	torchInstallSize   = 3 * gigabyte
+	cudaInstallSize    = 5 * gigabyte
+	toolingInstallSize = gigabyte / 2
+)
+
+func jupyterDiskEstimate() uint64 {
+	size := uint64(jupyterInstallSize)
+	if config.EnableCUDA {
+		size += cudaInstallSize
+	} else if config.EnableMPS {
+		size += torchInstallSize
+	}
+	return size
 }
 
-func installComponent(c string) {
+func checkDiskSpace(required uint64) bool {
+	free, err := freeDiskSpace(cloudlabDir)
+	if err != nil {
+		printWarning("Could not determine free disk space: " + err.Error())
+		return true
+	}
+	printInfo(fmt.Sprintf("Disk: %s free, ~%s needed", formatBytes(free), formatBytes(required)))
+	if free >= required {
+		return true
+	}
+	if forceFlag {
+		printWarning("Low disk space, continuing because of --force")
+		return true
+	}
+	printError("Not enough disk space. Free some space or re-run with --force")
+	return false
+}
+
+// reinstallComponent stops a component, deletes the files install would
+// otherwise find and skip over, and installs it again.
+func reinstallComponent(c string, yes bool) {
+	var stop func()
+	var remove []string
 	switch c {
-	case "all":
-		installAll()
-	case "uv":
-		installUV()
 	case "jupyter":
-		installJupyter()
+		stop = func() { stopPID("jupyter") }
+		remove = []string{filepath.Join(cloudlabDir, "venv"), filepath.Join(homeDir, ".jupyter")}
+	case "vscode":
+		stop = func() { stopPID("vscode") }
+		remove = []string{filepath.Join(homeDir, ".config", "code-server")}
+	case "ssh", "ttyd", "gotty":
+		stop = func() { stopPID("ssh") }
+	case "dashboard":
+		stop = func() { stopPID("dashboard") }
+		remove = []string{filepath.Join(cloudlabDir, "server.py"), filepath.Join(cloudlabDir, "dashboard.html")}
+	case "cloudflare", "cloudflared":
+		stop = stopAllTunnels
+	case "uv":
+		stop = func() {}
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+c)
+		return
+	}
+
+	if len(remove) > 0 && !yes {
+		fmt.Printf("\n%sReinstall %s?%s This deletes:\n", BrightYellow, c, Reset)
+		for _, p := range remove {
+			fmt.Printf("  %s\n", p)
+		}
+		fmt.Printf("Continue? [y/N]: ")
+		if strings.ToLower(readLine(bufio.NewReader(os.Stdin))) != "y" {
+			printInfo("Cancelled")
+			return
+		}
+	}
+
+	printHeader("♻️  REINSTALLING " + strings.ToUpper(c))
+	stop()
+	for _, p := range remove {
+		if err := os.RemoveAll(p); err != nil {
+			printErrorCode(errCode(err), "Failed to remove "+p+": "+err.Error())
+			return
+		}
+		printInfo("Removed " + p)
+	}
+	// Binaries may be system packages, so they're downloaded again over the
+	// top rather than deleted.
+	reinstalling = true
+	installComponent(c)
+}
+
+// ==================== Offline install ====================
+//
+// With `install --offline`, nothing is downloaded. offline_dir holds:
+//
+//	bin/        uv, ttyd, gotty, cloudflared, code-server (or a
+//	            code-server-*.tar.gz standalone release at the top level)
+//	wheels/     a wheelhouse for uv pip (jupyterlab, notebook, ipykernel, ...)
+
+func checkOfflineDir() bool {
+	if config.OfflineDir == "" {
+		printError("--offline needs offline_dir. Run: cloudlab config set offline_dir <path>")
+		return false
+	}
+	if info, err := os.Stat(config.OfflineDir); err != nil || !info.IsDir() {
+		printErrorCode(codeNotFound, "offline_dir not found: "+config.OfflineDir)
+		return false
+	}
+	return true
+}
+
+// installOfflineBinary copies bin/<name> from offline_dir into CloudLab's own
+// bin directory, which is on PATH for every cloudlab command.
+func installOfflineBinary(name string) error {
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	src := filepath.Join(config.OfflineDir, "bin", name)
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("%s is missing from offline_dir (expected %s)", name, src)
+	}
+	binDir := filepath.Join(cloudlabDir, "bin")
+	os.MkdirAll(binDir, 0755)
+	if err := os.WriteFile(filepath.Join(binDir, name), data, 0755); err != nil {
+		return err
+	}
+	printSuccess(name + " installed from " + src)
+	return nil
+}
+
+// installOfflineVSCode unpacks a code-server standalone release the way its
+// install script does, or falls back to a plain bin/code-server.
+func installOfflineVSCode() error {
+	tarballs, _ := filepath.Glob(filepath.Join(config.OfflineDir, "code-server-*.tar.gz"))
+	if len(tarballs) == 0 {
+		return installOfflineBinary("code-server")
+	}
+	libDir := filepath.Join(cloudlabDir, "lib")
+	os.MkdirAll(libDir, 0755)
+	if err := runCmd("extract code-server", command("tar", "-xzf", tarballs[len(tarballs)-1], "-C", libDir)); err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(tarballs[len(tarballs)-1]), ".tar.gz")
+	binDir := filepath.Join(cloudlabDir, "bin")
+	os.MkdirAll(binDir, 0755)
+	link := filepath.Join(binDir, "code-server")
+	os.Remove(link)
+	if err := os.Symlink(filepath.Join(libDir, name, "bin", "code-server"), link); err != nil {
+		return err
+	}
+	printSuccess("code-server installed from " + tarballs[len(tarballs)-1])
+	return nil
+}
+
+// uvOfflineArgs keeps uv off the network and points pip at the wheelhouse.
+func uvOfflineArgs() []string {
+	if !offlineFlag {
+		return nil
+	}
+	return []string{"--offline", "--no-index", "--find-links", filepath.Join(config.OfflineDir, "wheels")}
+}
+
+func installAll() {
+	printHeader("📦 INSTALLING")
+	if !checkDiskSpace(jupyterDiskEstimate() + toolingInstallSize) {
+		return
+	}
+	installUV()
+	installJupyter()
+	installVSCode()
+	installTerminal()
+	installCloudflared()
+	createDashboardFiles()
+	printSuccess("All components installed!")
+	showComponentVersions(true)
+}
+
+// componentVersions asks each installed tool for its version. Tools that
+// aren't installed are left out.
+func componentVersions() map[string]string {
+	versions := map[string]string{}
+	ask := func(key, bin string, args ...string) {
+		if bin == "" {
+			return
+		}
+		ctx, cancel := context.WithTimeout(rootCtx, 15*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, bin, args...)
+		cmd.WaitDelay = time.Second
+		out, err := cmd.Output()
+		if err != nil {
+			return
+		}
+		line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if line == "" {
+			return
+		}
+		if v := versionRe.FindString(line); v != "" {
+			line = v
+		}
+		versions[key] = line
+	}
+	look := func(name string) string {
+		p, _ := exec.LookPath(name)
+		return p
+	}
+
+	uv := getUVPath()
+	ask("uv", uv, "--version")
+	venv := envPath("cloudlab")
+	if cfg := readPyvenvCfg(venv); cfg != nil {
+		versions["python"] = cfg["version_info"]
+		if uv != "" {
+			if pkgs, err := envPackages(uv, envPython(venv)); err == nil {
+				for _, p := range pkgs {
+					switch strings.ToLower(p.Name) {
+					case "jupyterlab", "notebook", "ipykernel":
+						versions[strings.ToLower(p.Name)] = p.Version
+					}
+				}
+			}
+		}
+	}
+	ask("code-server", getVSCodePath(), "--version")
+	ask("ttyd", look("ttyd"), "--version")
+	ask("gotty", getGoTTYPath(), "--version")
+	ask("cloudflared", look("cloudflared"), "--version")
+	return versions
+}
+
+var versionRe = regexp.MustCompile(`\d+\.\d+(\.\d+)?[0-9A-Za-z.+-]*`)
+
+// showComponentVersions prints the version manifest and, with save, writes
+// it to versions.json for bug reports.
+func showComponentVersions(save bool) {
+	versions := componentVersions()
+	printHeader("🏷️  COMPONENT VERSIONS")
+	fmt.Printf("  %-14s %s%s%s\n", "cloudlab", BrightCyan, VERSION, Reset)
+	for _, key := range []string{"uv", "python", "jupyterlab", "notebook", "ipykernel", "code-server", "ttyd", "gotty", "cloudflared"} {
+		if v, ok := versions[key]; ok {
+			fmt.Printf("  %-14s %s%s%s\n", key, BrightCyan, v, Reset)
+		}
+	}
+	fmt.Println()
+	if !save {
+		return
+	}
+	manifest := map[string]any{"cloudlab": VERSION, "generated": time.Now().Format(time.RFC3339), "components": versions}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	path := filepath.Join(cloudlabDir, "versions.json")
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		printWarning("Couldn't save " + path + ": " + err.Error())
+		return
+	}
+	printInfo("Saved to " + path)
+}
+
+func installComponent(c string) {
+	switch c {
+	case "all":
+		installAll()
+	case "uv":
+		installUV()
+	case "jupyter":
+		if checkDiskSpace(jupyterDiskEstimate()) {
+			installJupyter()
+		}
 	case "vscode":
 		installVSCode()
-	case "ssh", "ttyd":
+	case "ssh":
+		installTerminal()
+	case "ttyd":
 		installTTYD()
+	case "gotty":
+		installGoTTY()
 	case "cloudflare", "cloudflared":
 		installCloudflared()
 	case "dashboard":
 		createDashboardFiles()
 	default:
-		printError("Unknown: " + c)
+		printErrorCode(codeUnknown, "Unknown: "+c)
 	}
 }
 
 func installUV() {
 	printStep("Installing UV...")
-	if _, err := exec.LookPath("uv"); err == nil {
+	if _, err := exec.LookPath("uv"); err == nil && !reinstalling {
 		printSuccess("UV already installed")
 		return
 	}
+	if offlineFlag {
+		if err := installOfflineBinary("uv"); err != nil {
+			printErrorCode(errCode(err), err.Error())
+		}
+		return
+	}
 	var cmd *exec.Cmd
 	if runtime.GOOS == "windows" {
-		cmd = exec.Command("powershell", "-c", "irm https://astral.sh/uv/install.ps1 | iex")
+		cmd = exec.CommandContext(rootCtx, "powershell", "-c", "irm https://astral.sh/uv/install.ps1 | iex")
 	} else {
-		cmd = exec.Command("bash", "-c", "curl -LsSf https://astral.sh/uv/install.sh | sh")
+		cmd = exec.CommandContext(rootCtx, "bash", "-c", "curl -LsSf https://astral.sh/uv/install.sh | sh")
 	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Run()
-	printSuccess("UV installed")
+	if err := runCmd("uv installer", cmd); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "uv was not found after running the installer. Looked in: "+strings.Join(uvInstallDirs(), ", "))
+		return
+	}
+	printSuccess("UV installed at " + uv)
+	if _, err := exec.LookPath("uv"); err != nil {
+		printInfo(fmt.Sprintf("%s is not on your PATH. CloudLab will find it, but to use uv yourself add:", filepath.Dir(uv)))
+		if runtime.GOOS == "windows" {
+			fmt.Printf("    setx PATH \"%%PATH%%;%s\"\n", filepath.Dir(uv))
+		} else {
+			fmt.Printf("    export PATH=\"%s:$PATH\"\n", filepath.Dir(uv))
+		}
+	}
+}
+
+// uvInstallDirs lists where the uv installer may put the binary, in the
+// order it picks them, followed by older cargo-based locations.
+func uvInstallDirs() []string {
+	var dirs []string
+	for _, env := range []string{"UV_INSTALL_DIR", "XDG_BIN_HOME"} {
+		if dir := os.Getenv(env); filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		dirs = append(dirs, filepath.Join(dir, "..", "bin"))
+	}
+	dirs = append(dirs, filepath.Join(homeDir, ".local", "bin"))
+	if dir := os.Getenv("CARGO_HOME"); filepath.IsAbs(dir) {
+		dirs = append(dirs, filepath.Join(dir, "bin"))
+	}
+	return append(dirs, filepath.Join(homeDir, ".cargo", "bin"), "/usr/local/bin")
 }
 
 func getUVPath() string {
-	paths := []string{
-		filepath.Join(homeDir, ".cargo", "bin", "uv"),
-		filepath.Join(homeDir, ".local", "bin", "uv"),
-		"/usr/local/bin/uv",
+	name := "uv"
+	if runtime.GOOS == "windows" {
+		name = "uv.exe"
 	}
-	for _, p := range paths {
+	for _, dir := range uvInstallDirs() {
+		p := filepath.Join(dir, name)
 		if _, err := os.Stat(p); err == nil {
 			return p
 		}
@@ -602,71 +2478,274 @@ func getUVPath() string {
 	return ""
 }
 
+// getPythonPath is the default env's Python, where env install puts
+// packages. CloudLab's own tools run from envPath("cloudlab") instead.
 func getPythonPath() string {
-	venv := filepath.Join(cloudlabDir, "venv")
+	return envPython(envPath("default"))
+}
+
+// envPath maps an environment name to its directory. "cloudlab" is always
+// the main venv; "default" is whichever env `env default` selected.
+func envPath(name string) string {
+	if name == "default" {
+		name = config.DefaultEnv
+	}
+	if name == "" || name == "cloudlab" {
+		return filepath.Join(cloudlabDir, "venv")
+	}
+	if dir, ok := config.EnvDirs[name]; ok {
+		return dir
+	}
+	return filepath.Join(cloudlabDir, "envs", name)
+}
+
+// setEnvDir records that the environment name lives at dir instead of
+// under envs/, so every command can keep referring to it by name. The
+// mapping is only written to config.json by saveEnvDir once the env exists.
+func setEnvDir(name, dir string) bool {
+	if name == "cloudlab" || name == "default" {
+		printError("--dir can't be used for the " + name + " environment")
+		return false
+	}
+	dir = expandPath(dir)
+	inTree := filepath.Join(cloudlabDir, "envs", name)
+	if _, err := os.Stat(inTree); err == nil {
+		printError(fmt.Sprintf("Environment %s already exists at %s. Remove it or pick another name", name, inTree))
+		return false
+	}
+	if old, ok := config.EnvDirs[name]; ok && old != dir && readPyvenvCfg(old) != nil {
+		printError(fmt.Sprintf("Environment %s already lives at %s. Remove it or pick another name", name, old))
+		return false
+	}
+	if config.EnvDirs == nil {
+		config.EnvDirs = map[string]string{}
+	}
+	config.EnvDirs[name] = dir
+	return true
+}
+
+// saveEnvDir keeps a --dir mapping if the env was created there and
+// forgets it if creation failed.
+func saveEnvDir(name string) {
+	if readPyvenvCfg(envPath(name)) == nil {
+		delete(config.EnvDirs, name)
+	}
+	saveConfig()
+}
+
+// removeEnvDir deletes an environment wherever it lives and forgets it.
+// A --dir env's directory is only deleted if it really is a venv.
+func removeEnvDir(name string) {
+	dir, ok := config.EnvDirs[name]
+	if !ok {
+		os.RemoveAll(envPath(name))
+		return
+	}
+	if readPyvenvCfg(dir) != nil {
+		os.RemoveAll(dir)
+	} else if _, err := os.Stat(dir); err == nil {
+		printWarning(dir + " is not a virtual environment; leaving it in place")
+	}
+	delete(config.EnvDirs, name)
+	saveConfig()
+}
+
+func envBinDir(env string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(env, "Scripts")
+	}
+	return filepath.Join(env, "bin")
+}
+
+func envPython(env string) string {
 	if runtime.GOOS == "windows" {
-		return filepath.Join(venv, "Scripts", "python.exe")
+		return filepath.Join(envBinDir(env), "python.exe")
+	}
+	return filepath.Join(envBinDir(env), "python")
+}
+
+func envEnviron(env string) []string {
+	var vars []string
+	for _, v := range os.Environ() {
+		key := strings.SplitN(v, "=", 2)[0]
+		if strings.EqualFold(key, "PATH") || key == "VIRTUAL_ENV" || key == "PYTHONHOME" {
+			continue
+		}
+		vars = append(vars, v)
 	}
-	return filepath.Join(venv, "bin", "python")
+	return append(vars,
+		"PATH="+envBinDir(env)+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"VIRTUAL_ENV="+env)
 }
 
+// getJupyterPath prefers Jupyter from the default environment and falls
+// back to the main venv when that env doesn't have it installed.
 func getJupyterPath() string {
-	venv := filepath.Join(cloudlabDir, "venv")
+	name := "jupyter"
 	if runtime.GOOS == "windows" {
-		return filepath.Join(venv, "Scripts", "jupyter.exe")
+		name = "jupyter.exe"
+	}
+	if config.UseSysJupyter {
+		if jp := systemJupyter(); jp != "" {
+			return jp
+		}
+	}
+	jp := filepath.Join(envBinDir(envPath("default")), name)
+	if _, err := os.Stat(jp); err == nil {
+		return jp
+	}
+	jp = filepath.Join(envBinDir(envPath("cloudlab")), name)
+	if _, err := os.Stat(jp); err != nil {
+		// Nothing of ours installed yet; manage an existing Jupyter if there is one.
+		if sys := systemJupyter(); sys != "" {
+			return sys
+		}
+	}
+	return jp
+}
+
+// systemJupyter is a jupyter on PATH that CloudLab didn't install.
+func systemJupyter() string {
+	jp, err := exec.LookPath("jupyter")
+	if err != nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(jp); err == nil {
+		jp = abs
+	}
+	if strings.HasPrefix(jp, cloudlabDir+string(filepath.Separator)) {
+		return ""
 	}
-	return filepath.Join(venv, "bin", "jupyter")
+	return jp
+}
+
+// getVSCodePath finds code-server on PATH or where its standalone
+// installer puts it, so an existing install is reused.
+func getVSCodePath() string {
+	if cs, err := exec.LookPath("code-server"); err == nil {
+		return cs
+	}
+	cs := filepath.Join(homeDir, ".local", "bin", "code-server")
+	if _, err := os.Stat(cs); err == nil {
+		return cs
+	}
+	return ""
 }
 
 func installJupyter() {
 	printStep("Installing Jupyter...")
+	if config.UseSysJupyter {
+		if jp := systemJupyter(); jp != "" {
+			printSuccess("Using system Jupyter at " + jp)
+			configureJupyter()
+			return
+		}
+		printWarning("use_system_jupyter is set but no jupyter is on PATH; installing CloudLab's own")
+	}
 	uv := getUVPath()
 	if uv == "" {
 		installUV()
 		uv = getUVPath()
 	}
 	if uv == "" {
-		printError("UV not found")
+		printErrorCode(codeNotInstalled, "UV not found")
 		return
 	}
 
+	python, err := pythonFor("")
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
 	venv := filepath.Join(cloudlabDir, "venv")
-	exec.Command(uv, "venv", venv, "--python", config.PythonVersion).Run()
+	uvArgs := []string{"venv", venv, "--python", python}
+	if offlineFlag {
+		uvArgs = append(uvArgs, "--offline")
+	}
+	if err := runCmd("uv venv", command(uv, uvArgs...)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
 
-	py := getPythonPath()
+	py := envPython(venv)
 	pkgs := []string{"jupyterlab", "notebook", "ipykernel", "ipywidgets"}
 	for _, pkg := range pkgs {
-		exec.Command(uv, "pip", "install", pkg, "--python", py).Run()
+		args := append([]string{"pip", "install", pkg, "--python", py}, uvOfflineArgs()...)
+		if err := runCmd("pip install "+pkg, command(uv, args...)); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
 	}
 
 	// PyTorch
-	if config.EnableMPS {
-		exec.Command(uv, "pip", "install", "torch", "torchvision", "--python", py).Run()
-	} else if config.EnableCUDA {
-		exec.Command(uv, "pip", "install", "torch", "torchvision", "--index-url", "https://download.pytorch.org/whl/cu121", "--python", py).Run()
+	if torch := torchCmd(uv, py); torch != nil {
+		if err := runCmd("pip install torch", torch); err != nil {
+			printWarning(err.Error())
+		}
 	}
 
 	// Register kernel
-	exec.Command(py, "-m", "ipykernel", "install", "--user", "--name", "cloudlab", "--display-name", "Python "+config.PythonVersion+" (CloudLab)").Run()
+	if err := runCmd("ipykernel install", command(py, "-m", "ipykernel", "install", "--user", "--name", "cloudlab", "--display-name", "Python "+config.PythonVersion+" (CloudLab)")); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
 
-	configureJupyter()
+	if !configureJupyter() {
+		return
+	}
 	printSuccess("Jupyter installed")
 }
 
-func configureJupyter() {
+// torchCmd installs PyTorch for the enabled GPU backend, or returns nil
+// when neither enable_mps nor enable_cuda is set.
+func torchCmd(uv, py string) *exec.Cmd {
+	if offlineFlag {
+		// Only if the wheelhouse has it; a missing torch isn't fatal offline.
+		if offlineHasTorch() {
+			return command(uv, append([]string{"pip", "install", "torch", "torchvision", "--python", py}, uvOfflineArgs()...)...)
+		}
+	} else if config.EnableMPS {
+		return command(uv, "pip", "install", "torch", "torchvision", "--python", py)
+	} else if config.EnableCUDA {
+		return command(uv, "pip", "install", "torch", "torchvision", "--index-url", "https://download.pytorch.org/whl/cu121", "--python", py)
+	}
+	return nil
+}
+
+// offlineHasTorch reports whether offline_dir's wheelhouse has a torch wheel.
+func offlineHasTorch() bool {
+	matches, _ := filepath.Glob(filepath.Join(config.OfflineDir, "wheels", "torch-*.whl"))
+	return len(matches) > 0
+}
+
+// cpuTorchCmd installs the CPU-only PyTorch build, which skips the CUDA
+// libraries the default Linux wheels pull in.
+func cpuTorchCmd(uv, py string) *exec.Cmd {
+	if runtime.GOOS == "darwin" {
+		return command(uv, "pip", "install", "torch", "torchvision", "--python", py)
+	}
+	return command(uv, "pip", "install", "torch", "torchvision", "--index-url", "https://download.pytorch.org/whl/cpu", "--python", py)
+}
+
+// configureJupyter writes ~/.jupyter's config from config.json. It writes
+// nothing, and reports false, if the password can't be hashed: an empty
+// hash would turn the password off.
+func configureJupyter() bool {
+	if _, err := os.Stat(getJupyterPath()); err != nil {
+		// Not installed yet; installing it writes the config.
+		return true
+	}
 	jupyterDir := filepath.Join(homeDir, ".jupyter")
 	os.MkdirAll(jupyterDir, 0755)
 
-	py := getPythonPath()
-	hashCmd := fmt.Sprintf(`from jupyter_server.auth import passwd; print(passwd('%s'))`, config.JupyterPassword)
-	out, _ := exec.Command(py, "-c", hashCmd).Output()
-	hash := strings.TrimSpace(string(out))
-	if hash == "" {
-		hash = "''"
+	hash, err := jupyterPasswordHash(config.JupyterPassword)
+	if err != nil {
+		printErrorCode(errCode(err), "Jupyter config not written: "+err.Error())
+		return false
 	}
 
 	cfg := fmt.Sprintf(`c = get_config()
-c.ServerApp.ip = '0.0.0.0'
+c.ServerApp.ip = '%s'
 c.ServerApp.port = %d
 c.ServerApp.open_browser = False
 c.ServerApp.allow_root = True
@@ -674,30 +2753,103 @@ c.ServerApp.allow_origin = '*'
 c.ServerApp.root_dir = '%s'
 c.ServerApp.password = '%s'
 c.ServerApp.token = ''
-c.NotebookApp.ip = '0.0.0.0'
+c.NotebookApp.ip = '%s'
 c.NotebookApp.port = %d
 c.NotebookApp.open_browser = False
 c.NotebookApp.allow_root = True
 c.NotebookApp.notebook_dir = '%s'
 c.NotebookApp.password = '%s'
 c.NotebookApp.token = ''
-`, config.JupyterPort, config.WorkDir, hash, config.JupyterPort, config.WorkDir, hash)
+`, bindAddress(), config.JupyterPort, config.WorkDir, hash, bindAddress(), config.JupyterPort, config.WorkDir, hash)
+	if config.JupyterSocket != "" {
+		cfg += fmt.Sprintf("c.ServerApp.sock = '%s'\nc.NotebookApp.sock = '%s'\n", config.JupyterSocket, config.JupyterSocket)
+	}
 
 	os.WriteFile(filepath.Join(jupyterDir, "jupyter_lab_config.py"), []byte(cfg), 0644)
 	os.WriteFile(filepath.Join(jupyterDir, "jupyter_server_config.py"), []byte(cfg), 0644)
+	return true
+}
+
+// jupyterPasswordHash hashes pw the way Jupyter's password setting expects.
+func jupyterPasswordHash(pw string) (string, error) {
+	py, err := jupyterPython()
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(py, "-c", "import sys; from jupyter_server.auth import passwd; print(passwd(sys.argv[1]))", pw).Output()
+	hash := strings.TrimSpace(string(out))
+	if err == nil && hash == "" {
+		err = errors.New("no output")
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not hash the password with %s: %v", py, err)
+	}
+	return hash, nil
+}
+
+// jupyterPython is the interpreter Jupyter runs on: the main venv's, or for
+// a system or pipx Jupyter the one its launcher points at.
+func jupyterPython() (string, error) {
+	py := envPython(envPath("cloudlab"))
+	if _, err := os.Stat(py); err == nil {
+		return py, nil
+	}
+	jp := getJupyterPath()
+	if runtime.GOOS == "windows" {
+		// jupyter.exe is in Scripts, next to a venv's python.exe or one
+		// level below a system install's.
+		for _, dir := range []string{filepath.Dir(jp), filepath.Dir(filepath.Dir(jp))} {
+			py := filepath.Join(dir, "python.exe")
+			if _, err := os.Stat(py); err == nil {
+				return py, nil
+			}
+		}
+		return "", fmt.Errorf("no python.exe found for %s", jp)
+	}
+	f, err := os.Open(jp)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if shebang, ok := strings.CutPrefix(strings.TrimSpace(line), "#!"); ok {
+		fields := strings.Fields(shebang)
+		if len(fields) > 1 && filepath.Base(fields[0]) == "env" {
+			return exec.LookPath(fields[1])
+		}
+		if len(fields) > 0 {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("can't tell which Python runs %s", jp)
 }
 
 func installVSCode() {
 	printStep("Installing VS Code Server...")
-	if _, err := exec.LookPath("code-server"); err == nil {
-		printSuccess("code-server already installed")
+	if cs := getVSCodePath(); cs != "" && !reinstalling {
+		printSuccess("code-server already installed at " + cs)
+		configureVSCode()
+		return
+	}
+	if config.UseSysVSCode {
+		printErrorCode(codeNotInstalled, "use_system_vscode is set but code-server was not found. Install it or run: cloudlab config set use_system_vscode false")
+		return
+	}
+	if offlineFlag {
+		if err := installOfflineVSCode(); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
 		configureVSCode()
 		return
 	}
-	cmd := exec.Command("bash", "-c", "curl -fsSL https://code-server.dev/install.sh | sh")
+	cmd := exec.CommandContext(rootCtx, "bash", "-c", "curl -fsSL https://code-server.dev/install.sh | sh")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Run()
+	if err := runCmd("code-server installer", cmd); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
 	configureVSCode()
 	printSuccess("VS Code installed")
 }
@@ -705,61 +2857,215 @@ func installVSCode() {
 func configureVSCode() {
 	cfgDir := filepath.Join(homeDir, ".config", "code-server")
 	os.MkdirAll(cfgDir, 0755)
-	cfg := fmt.Sprintf(`bind-addr: 0.0.0.0:%d
+	cfg := fmt.Sprintf(`bind-addr: %s
 auth: password
 password: %s
 cert: false
-`, config.VSCodePort, config.VSCodePassword)
+`, net.JoinHostPort(bindAddress(), strconv.Itoa(config.VSCodePort)), config.VSCodePassword)
 	os.WriteFile(filepath.Join(cfgDir, "config.yaml"), []byte(cfg), 0644)
 }
 
+// canSudo reports whether system-wide installs can go ahead without a
+// password prompt: we're root, or sudo works non-interactively.
+func canSudo() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	if _, err := exec.LookPath("sudo"); err != nil {
+		return false
+	}
+	return command("sudo", "-n", "true").Run() == nil
+}
+
+// asRoot runs a command directly when we're root (containers often have no
+// sudo) and through sudo -n otherwise.
+func asRoot(name string, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 {
+		return command(name, args...)
+	}
+	return command("sudo", append([]string{"-n", name}, args...)...)
+}
+
+// installBinary moves a downloaded binary to /usr/local/bin, or to
+// ~/.local/bin when sudo isn't usable, and says where it went.
+func installBinary(src, name string) error {
+	os.Chmod(src, 0755)
+	if canSudo() {
+		dest := filepath.Join("/usr/local/bin", name)
+		if err := runCmd("install "+name, asRoot("mv", src, dest)); err != nil {
+			return err
+		}
+		printInfo(name + " installed to " + dest)
+		return nil
+	}
+	dir := filepath.Join(homeDir, ".local", "bin")
+	dest := filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// A plain rename fails across filesystems (/tmp is often tmpfs).
+	data, err := os.ReadFile(src)
+	if err == nil {
+		err = os.WriteFile(dest, data, 0755)
+	}
+	if err != nil {
+		return fmt.Errorf("install %s: %w", name, err)
+	}
+	os.Remove(src)
+	printInfo(fmt.Sprintf("sudo isn't available without a password, so %s went to %s", name, dest))
+	if !inUserPath(dir) {
+		printWarning("Add it to your PATH: echo 'export PATH=\"$HOME/.local/bin:$PATH\"' >> ~/.bashrc")
+	}
+	return nil
+}
+
+// inUserPath checks the PATH the user's shell had, before CloudLab added
+// its own directories.
+func inUserPath(dir string) bool {
+	for _, p := range filepath.SplitList(userPath) {
+		if filepath.Clean(p) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
 func installTTYD() {
 	printStep("Installing SSH Terminal (ttyd)...")
-	if _, err := exec.LookPath("ttyd"); err == nil {
+	if _, err := exec.LookPath("ttyd"); err == nil && !reinstalling {
 		printSuccess("ttyd already installed")
 		return
 	}
+	if offlineFlag {
+		if err := installOfflineBinary("ttyd"); err != nil {
+			printErrorCode(errCode(err), err.Error())
+		}
+		return
+	}
 
+	var err error
 	switch runtime.GOOS {
 	case "darwin":
-		exec.Command("brew", "install", "ttyd").Run()
+		err = runCmd("brew install ttyd", command("brew", "install", "ttyd"))
 	case "linux":
 		// Try apt first
-		if _, err := exec.LookPath("apt-get"); err == nil {
-			exec.Command("sudo", "apt-get", "update").Run()
-			exec.Command("sudo", "apt-get", "install", "-y", "ttyd").Run()
+		if _, lookErr := exec.LookPath("apt-get"); lookErr == nil && canSudo() {
+			asRoot("apt-get", "update").Run()
+			err = runCmd("apt-get install ttyd", asRoot("apt-get", "install", "-y", "ttyd"))
 		} else {
 			// Download binary
 			url := "https://github.com/tsl0922/ttyd/releases/latest/download/ttyd.x86_64"
 			if runtime.GOARCH == "arm64" {
 				url = "https://github.com/tsl0922/ttyd/releases/latest/download/ttyd.aarch64"
 			}
-			downloadFile("/tmp/ttyd", url)
-			os.Chmod("/tmp/ttyd", 0755)
-			exec.Command("sudo", "mv", "/tmp/ttyd", "/usr/local/bin/ttyd").Run()
+			if err = downloadFile("/tmp/ttyd", url); err == nil {
+				err = installBinary("/tmp/ttyd", "ttyd")
+			}
 		}
 	}
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
 	printSuccess("ttyd installed")
 }
 
+func installTerminal() {
+	switch config.TerminalBackend {
+	case "gotty":
+		installGoTTY()
+	case "builtin":
+		printSuccess("The built-in web terminal needs nothing installed")
+	default:
+		installTTYD()
+	}
+}
+
+func getGoTTYPath() string {
+	if p, err := exec.LookPath("gotty"); err == nil {
+		return p
+	}
+	p := filepath.Join(cloudlabDir, "bin", "gotty")
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	return ""
+}
+
+const gottyVersion = "v1.5.0"
+
+func installGoTTY() {
+	printStep("Installing SSH Terminal (gotty)...")
+	if getGoTTYPath() != "" && !reinstalling {
+		printSuccess("gotty already installed")
+		return
+	}
+	if offlineFlag {
+		if err := installOfflineBinary("gotty"); err != nil {
+			printErrorCode(errCode(err), err.Error())
+		}
+		return
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		if err := runCmd("brew install gotty", command("brew", "install", "gotty")); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+	case "linux":
+		arch := "amd64"
+		if runtime.GOARCH == "arm64" {
+			arch = "arm64"
+		}
+		url := fmt.Sprintf("https://github.com/sorenisanerd/gotty/releases/download/%s/gotty_%s_linux_%s.tar.gz", gottyVersion, gottyVersion, arch)
+		binDir := filepath.Join(cloudlabDir, "bin")
+		os.MkdirAll(binDir, 0755)
+		if err := downloadFile("/tmp/gotty.tar.gz", url); err != nil {
+			printErrorCode(errCode(err), "Download failed: "+err.Error())
+			return
+		}
+		defer os.Remove("/tmp/gotty.tar.gz")
+		if err := runCmd("extract gotty", command("tar", "-xzf", "/tmp/gotty.tar.gz", "-C", binDir, "gotty")); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+	default:
+		printError("gotty install is not supported on " + runtime.GOOS + "; install it manually")
+		return
+	}
+	printSuccess("gotty installed")
+}
+
 func installCloudflared() {
 	printStep("Installing Cloudflared...")
-	if _, err := exec.LookPath("cloudflared"); err == nil {
+	if _, err := exec.LookPath("cloudflared"); err == nil && !reinstalling {
 		printSuccess("cloudflared already installed")
 		return
 	}
+	if offlineFlag {
+		if err := installOfflineBinary("cloudflared"); err != nil {
+			printErrorCode(errCode(err), err.Error())
+		}
+		return
+	}
 
+	var err error
 	switch runtime.GOOS {
 	case "darwin":
-		exec.Command("brew", "install", "cloudflared").Run()
+		err = runCmd("brew install cloudflared", command("brew", "install", "cloudflared"))
 	case "linux":
 		url := "https://github.com/cloudflare/cloudflared/releases/latest/download/cloudflared-linux-amd64"
 		if runtime.GOARCH == "arm64" {
 			url = "https://github.com/cloudflare/cloudflared/releases/latest/download/cloudflared-linux-arm64"
 		}
-		downloadFile("/tmp/cloudflared", url)
-		os.Chmod("/tmp/cloudflared", 0755)
-		exec.Command("sudo", "mv", "/tmp/cloudflared", "/usr/local/bin/cloudflared").Run()
+		if err = downloadFile("/tmp/cloudflared", url); err == nil {
+			err = installBinary("/tmp/cloudflared", "cloudflared")
+		}
+	}
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
 	}
 	printSuccess("cloudflared installed")
 }
@@ -780,7 +3086,9 @@ import socket
 import psutil
 
 PORT = int(os.environ.get('CLOUDLAB_PORT', 3000))
-DIR = os.path.expanduser('~/.cloudlab')
+BIND = os.environ.get('CLOUDLAB_BIND', '0.0.0.0')
+DIR = os.environ.get('CLOUDLAB_DIR', os.path.expanduser('~/.cloudlab'))
+CONFIG = os.environ.get('CLOUDLAB_CONFIG', os.path.join(DIR, 'config.json'))
 
 def check_port(port):
     """Check if a port is in use"""
@@ -811,7 +3119,7 @@ def check_process(name):
 
 def get_config():
     try:
-        with open(os.path.join(DIR, 'config.json'), 'r') as f:
+        with open(CONFIG, 'r') as f:
             return json.load(f)
     except:
         return {}
@@ -917,6 +3225,7 @@ class Handler(http.server.BaseHTTPRequestHandler):
 
 class Server(socketserver.TCPServer):
     allow_reuse_address = True
+    address_family = socket.AF_INET6 if ':' in BIND else socket.AF_INET
 
 if __name__ == '__main__':
     # Install psutil if not available
@@ -927,7 +3236,7 @@ if __name__ == '__main__':
         import psutil
     
     print(f'Dashboard: http://localhost:{PORT}')
-    with Server(('0.0.0.0', PORT), Handler) as server:
+    with Server((BIND, PORT), Handler) as server:
         server.serve_forever()
 `
 	os.WriteFile(filepath.Join(cloudlabDir, "server.py"), []byte(serverPy), 0755)
@@ -941,635 +3250,5136 @@ if __name__ == '__main__':
 	printSuccess("Dashboard files created")
 }
 
-// ==================== Start/Stop ====================
+// ==================== Services ====================
+
+// Service describes one of the processes CloudLab manages. Its Name doubles
+// as the PID file, log file and tunnel suffix.
+type Service struct {
+	Name    string
+	Label   string
+	Icon    string
+	Detail  string
+	Aliases []string
+	Start   func()
+	Port    func() int
+	Socket  func() string
+	URL     func() *string
+}
 
-func startService(s string) {
-	switch s {
-	case "all":
-		startAll()
-	case "jupyter", "lab":
-		startJupyter("lab")
-	case "notebook":
-		startJupyter("notebook")
-	case "vscode":
-		startVSCode()
-	case "ssh":
-		startSSH()
-	case "dashboard":
-		startDashboard()
-	case "tunnel", "tunnels":
-		startAllTunnels()
-	default:
-		printError("Unknown: " + s)
+func services() []Service {
+	list := []Service{
+		{
+			Name: "jupyter", Label: "Jupyter", Icon: "🐍", Detail: jupyterMode(),
+			Aliases: []string{"lab", "notebook"},
+			Start:   func() { startJupyter(config.JupyterMode) },
+			Port:    func() int { return config.JupyterPort },
+			Socket:  func() string { return config.JupyterSocket },
+			URL:     func() *string { return &config.TunnelURLs.Jupyter },
+		},
+		{
+			Name: "vscode", Label: "VS Code", Icon: "💻",
+			Start: startVSCode,
+			Port:  func() int { return config.VSCodePort },
+			URL:   func() *string { return &config.TunnelURLs.VSCode },
+		},
+		{
+			Name: "ssh", Label: "SSH Terminal", Icon: "🔒",
+			Aliases: []string{"webssh", "terminal", "ttyd", "gotty"},
+			Start:   startSSH,
+			Port:    func() int { return config.SSHPort },
+			URL:     func() *string { return &config.TunnelURLs.SSH },
+		},
+		{
+			Name: "dashboard", Label: "Dashboard", Icon: "📊",
+			Start: startDashboard,
+			Port:  func() int { return config.DashboardPort },
+			URL:   func() *string { return &config.TunnelURLs.Dashboard },
+		},
+	}
+	if config.ViewerPassword != "" || isRunning("viewer") {
+		list = append(list, Service{
+			Name: "viewer", Label: "Jupyter Viewer", Icon: "👀",
+			Start: startViewer,
+			Port:  func() int { return config.ViewerPort },
+			URL:   func() *string { return &config.TunnelURLs.Viewer },
+		})
 	}
+	return list
 }
 
-func startAll() {
-	printHeader("🚀 STARTING ALL SERVICES")
-	startJupyter(config.JupyterMode)
-	startVSCode()
-	startSSH()
-	startDashboard()
-	time.Sleep(2 * time.Second)
-	startAllTunnels()
-	printSuccess("All services started!")
+func findService(name string) *Service {
+	for _, s := range services() {
+		if s.Name == name {
+			return &s
+		}
+		for _, a := range s.Aliases {
+			if a == name {
+				return &s
+			}
+		}
+	}
+	return nil
 }
 
-func startJupyter(mode string) {
-	printStep("Starting Jupyter " + mode + "...")
-	jp := getJupyterPath()
-	if _, err := os.Stat(jp); err != nil {
-		printError("Jupyter not found. Run: cloudlab install jupyter")
-		return
+// resolveService maps a name or alias given on the command line to the
+// canonical PID/log names it refers to. "tunnels" expands to every tunnel.
+func resolveService(name string) []string {
+	switch name {
+	case "tunnel", "tunnels":
+		var names []string
+		for _, svc := range services() {
+			names = append(names, svc.TunnelName())
+		}
+		for _, t := range config.Terminals {
+			if t.Tunnel {
+				names = append(names, "tunnel_"+t.pidName())
+			}
+		}
+		return names
 	}
-
-	stopPID("jupyter")
-	time.Sleep(500 * time.Millisecond)
-
-	var cmd *exec.Cmd
-	if mode == "lab" {
-		cmd = exec.Command(jp, "lab", "--no-browser", "--ip=0.0.0.0",
-			fmt.Sprintf("--port=%d", config.JupyterPort),
-			fmt.Sprintf("--notebook-dir=%s", config.WorkDir),
-			"--ServerApp.token=''", "--ServerApp.allow_origin='*'")
-	} else {
-		cmd = exec.Command(jp, "notebook", "--no-browser", "--ip=0.0.0.0",
-			fmt.Sprintf("--port=%d", config.JupyterPort),
-			fmt.Sprintf("--notebook-dir=%s", config.WorkDir),
-			"--NotebookApp.token=''", "--NotebookApp.allow_origin='*'")
+	if rest, ok := strings.CutPrefix(name, "tunnel_"); ok {
+		if svc := findService(rest); svc != nil {
+			return []string{svc.TunnelName()}
+		}
 	}
-	cmd.Dir = config.WorkDir
+	if svc := findService(name); svc != nil {
+		return []string{svc.Name}
+	}
+	return []string{name}
+}
 
-	logFile, _ := os.Create(filepath.Join(cloudlabDir, "logs", "jupyter.log"))
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
+func (s Service) LogFile() string {
+	return filepath.Join(cloudlabDir, "logs", s.Name+".log")
+}
 
-	if err := cmd.Start(); err != nil {
-		printError("Failed: " + err.Error())
-		return
+// Where describes the address the service listens on for status output.
+func (s Service) Where() string {
+	if s.Socket != nil && s.Socket() != "" {
+		return "socket " + s.Socket()
 	}
-	savePID("jupyter", cmd.Process.Pid)
-	fmt.Printf("  %s✓%s Jupyter %s on port %s%d%s\n", BrightGreen, Reset, mode, BrightCyan, config.JupyterPort, Reset)
+	return fmt.Sprintf("port %d", s.Port())
 }
 
-func startVSCode() {
-	printStep("Starting VS Code...")
-	cs, err := exec.LookPath("code-server")
-	if err != nil {
-		printError("code-server not found. Run: cloudlab install vscode")
-		return
-	}
+func (s Service) TunnelName() string {
+	return "tunnel_" + s.Name
+}
 
-	stopPID("vscode")
-	time.Sleep(500 * time.Millisecond)
+func (s Service) Stop() {
+	stopPID(s.Name)
+}
 
-	cmd := exec.Command(cs, fmt.Sprintf("--bind-addr=0.0.0.0:%d", config.VSCodePort), config.WorkDir)
-	cmd.Dir = config.WorkDir
+// Enabled reports whether start all and stop all manage the service; see the
+// <name>_enabled config keys. The dashboard can't be disabled.
+func (s Service) Enabled() bool {
+	switch s.Name {
+	case "jupyter":
+		return config.JupyterEnabled
+	case "vscode":
+		return config.VSCodeEnabled
+	case "ssh":
+		return config.SSHEnabled
+	case "viewer":
+		return config.ViewerPassword != ""
+	}
+	return true
+}
 
-	logFile, _ := os.Create(filepath.Join(cloudlabDir, "logs", "vscode.log"))
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
+// ==================== Start/Stop ====================
 
-	if err := cmd.Start(); err != nil {
-		printError("Failed: " + err.Error())
+func startService(s string) {
+	switch s {
+	case "all":
+		startAll()
+		return
+	case "lab", "notebook":
+		startJupyter(s)
+		return
+	case "tunnel", "tunnels":
+		startAllTunnels()
 		return
 	}
-	savePID("vscode", cmd.Process.Pid)
-	fmt.Printf("  %s✓%s VS Code on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.VSCodePort, Reset)
-}
-
-func startSSH() {
-	printStep("Starting SSH Terminal...")
-	ttyd, err := exec.LookPath("ttyd")
-	if err != nil {
-		printError("ttyd not found. Run: cloudlab install ssh")
+	if svc := findService(s); svc != nil {
+		svc.Start()
 		return
 	}
+	printErrorCode(codeUnknown, "Unknown: "+s)
+}
 
-	stopPID("ssh")
-	time.Sleep(500 * time.Millisecond)
-
-	args := []string{"--port", strconv.Itoa(config.SSHPort), "--writable"}
-	if config.SSHPassword != "" {
-		args = append(args, "--credential", fmt.Sprintf("%s:%s", config.SSHUser, config.SSHPassword))
+// recreateConfig rewrites the Jupyter and/or code-server config files from
+// config.json, for when they were edited by hand or left by an old version.
+// It reports false if one couldn't be written.
+func recreateConfig(name string) bool {
+	svc := "all"
+	if s := findService(name); s != nil {
+		svc = s.Name
+	}
+	if svc == "all" || svc == "jupyter" {
+		if !configureJupyter() {
+			return false
+		}
+		printInfo("Regenerated " + filepath.Join(homeDir, ".jupyter", "jupyter_lab_config.py") + " and jupyter_server_config.py")
 	}
+	if svc == "all" || svc == "vscode" {
+		configureVSCode()
+		printInfo("Regenerated " + filepath.Join(homeDir, ".config", "code-server", "config.yaml"))
+	}
+	if svc != "all" && svc != "jupyter" && svc != "vscode" {
+		printWarning("--recreate-config only applies to jupyter and vscode")
+	}
+	return true
+}
 
-	shell := "bash"
-	if runtime.GOOS == "windows" {
-		shell = "cmd.exe"
+// waitReleased waits (up to 5s) until the ports of the stopped service, or
+// of every service for "all", can be bound again.
+func waitReleased(name string) {
+	var ports []int
+	target := findService(name)
+	for _, svc := range services() {
+		if name != "all" && (target == nil || target.Name != svc.Name) {
+			continue
+		}
+		if svc.Socket == nil || svc.Socket() == "" {
+			ports = append(ports, svc.Port())
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		free := true
+		for _, p := range ports {
+			free = free && portFree(p)
+		}
+		if free || !sleepCtx(100*time.Millisecond) {
+			return
+		}
 	}
-	args = append(args, shell, "-l")
+}
 
-	cmd := exec.Command(ttyd, args...)
-	cmd.Dir = config.WorkDir
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(bindAddress(), strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
 
-	logFile, _ := os.Create(filepath.Join(cloudlabDir, "logs", "ssh.log"))
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
+// rollingRestart brings a second instance up on a free port, moves the
+// tunnel over once it answers, and only then stops the old one. Behind a
+// named tunnel users see at most a reconnect.
+func rollingRestart(name string) {
+	svc := findService(name)
+	var port *int
+	if svc != nil {
+		switch svc.Name {
+		case "jupyter":
+			port = &config.JupyterPort
+		case "vscode":
+			port = &config.VSCodePort
+		case "dashboard":
+			port = &config.DashboardPort
+		}
+	}
+	if port == nil || (svc.Socket != nil && svc.Socket() != "") || !isRunning(svc.Name) {
+		printInfo("No rolling restart for " + name + " (not running, or not supported); restarting normally")
+		stopService(name)
+		waitReleased(name)
+		startService(name)
+		return
+	}
 
-	if err := cmd.Start(); err != nil {
-		printError("Failed: " + err.Error())
+	// The new instance stays on the free port it starts on, and that port
+	// is saved; hopping back would cost a second outage and tunnel move.
+	pids := filepath.Join(cloudlabDir, "pids")
+	old := svc.Name + ".old"
+	if err := os.Rename(filepath.Join(pids, svc.Name+".pid"), filepath.Join(pids, old+".pid")); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	oldPort := *port
+	p, err := freePort()
+	if err != nil {
+		printErrorCode(errCode(err), "Could not find a free port: "+err.Error())
+		os.Rename(filepath.Join(pids, old+".pid"), filepath.Join(pids, svc.Name+".pid"))
 		return
 	}
-	savePID("ssh", cmd.Process.Pid)
-	fmt.Printf("  %s✓%s SSH Terminal on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.SSHPort, Reset)
+	printStep(fmt.Sprintf("Rolling %s: starting a new instance on port %d...", svc.Label, p))
+	*port = p
+	svc.Start()
+	if !isRunning(svc.Name) {
+		printError(fmt.Sprintf("New %s didn't come up; the old one keeps serving on port %d", svc.Label, oldPort))
+		stopPID(svc.Name)
+		os.Rename(filepath.Join(pids, old+".pid"), filepath.Join(pids, svc.Name+".pid"))
+		*port = oldPort
+		return
+	}
+	saveConfig()
+	if isRunning(svc.TunnelName()) {
+		if _, named := config.NamedTunnels[svc.Name]; !named {
+			printWarning("Quick tunnel URLs change when repointed; use tunnel named to keep one")
+		}
+		restartTunnel(svc.Name)
+	}
+	stopPID(old)
+	printSuccess(fmt.Sprintf("%s restarted on port %d (was %d; saved as %s)", svc.Label, p, oldPort, svc.Name+"_port"))
 }
 
-func startDashboard() {
-	printStep("Starting Dashboard...")
-
-	py := getPythonPath()
-	if _, err := os.Stat(py); err != nil {
-		py = "python3"
-		if _, err := exec.LookPath(py); err != nil {
-			py = "python"
+func startAll() {
+	printHeader("🚀 STARTING ALL SERVICES")
+	for _, svc := range services() {
+		if !svc.Enabled() {
+			printInfo(fmt.Sprintf("Skipping %s (disabled; run: cloudlab config enable %s_enabled)", svc.Label, svc.Name))
+			continue
 		}
+		svc.Start()
 	}
-
-	stopPID("dashboard")
-	time.Sleep(500 * time.Millisecond)
-
-	// Copy latest dashboard.html
-	if _, err := os.Stat("index.html"); err == nil {
-		data, _ := os.ReadFile("index.html")
-		os.WriteFile(filepath.Join(cloudlabDir, "dashboard.html"), data, 0644)
+	time.Sleep(2 * time.Second)
+	if noTunnelFlag {
+		printInfo("Not starting tunnels (--no-tunnel)")
+	} else if config.TunnelEnabled {
+		startAllTunnels()
 	}
-
-	serverPath := filepath.Join(cloudlabDir, "server.py")
-	if _, err := os.Stat(serverPath); err != nil {
-		createDashboardFiles()
+	printSuccess("All services started!")
+	if config.DesktopNotify {
+		notifyServicesUp()
+	}
+	if isWSL() {
+		printWSLNote()
 	}
+}
 
-	cmd := exec.Command(py, serverPath)
-	cmd.Dir = cloudlabDir
-	cmd.Env = append(os.Environ(), fmt.Sprintf("CLOUDLAB_PORT=%d", config.DashboardPort))
+func isWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	data, err := os.ReadFile("/proc/version")
+	return err == nil && strings.Contains(strings.ToLower(string(data)), "microsoft")
+}
 
-	logFile, _ := os.Create(filepath.Join(cloudlabDir, "logs", "dashboard.log"))
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
+func wslAddress() string {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return ""
+}
 
-	if err := cmd.Start(); err != nil {
-		printError("Failed: " + err.Error())
-		return
+func printWSLNote() {
+	bind := bindAddress()
+	printInfo("Running inside WSL: services listen on " + bind + " (bind_address)")
+	fmt.Printf("     From Windows open %shttp://localhost:<port>%s", BrightCyan, Reset)
+	// The WSL address only works when services aren't bound to loopback.
+	if ip := wslAddress(); ip != "" && !net.ParseIP(bind).IsLoopback() {
+		fmt.Printf(", or %shttp://%s:<port>%s if localhost forwarding is off", BrightCyan, ip, Reset)
 	}
-	savePID("dashboard", cmd.Process.Pid)
-	fmt.Printf("  %s✓%s Dashboard on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.DashboardPort, Reset)
+	fmt.Println()
 }
 
-func stopService(s string) {
-	switch s {
-	case "all":
-		stopAll()
-	case "jupyter", "lab", "notebook":
-		stopPID("jupyter")
-		printSuccess("Jupyter stopped")
-	case "vscode":
-		stopPID("vscode")
-		printSuccess("VS Code stopped")
-	case "ssh":
-		stopPID("ssh")
-		printSuccess("SSH stopped")
-	case "dashboard":
-		stopPID("dashboard")
-		printSuccess("Dashboard stopped")
-	case "tunnel", "tunnels":
-		stopAllTunnels()
-	default:
-		printError("Unknown: " + s)
+// startForeground reports whether `start` should stay attached: --wait and
+// --foreground force it, --detach turns it off, otherwise default_start_mode decides.
+func startForeground(args []string) bool {
+	switch {
+	case hasFlag(args, "--wait", "--foreground", "--detach=false"):
+		return true
+	case hasFlag(args, "--detach", "--detach=true"):
+		return false
 	}
+	return config.StartMode == "foreground"
 }
 
-func stopAll() {
-	printHeader("🛑 STOPPING ALL")
-	stopAllTunnels()
-	stopPID("jupyter")
-	stopPID("vscode")
-	stopPID("ssh")
-	stopPID("dashboard")
-	printSuccess("All stopped")
+func waitForeground() {
+	supervise(30*time.Second, false)
 }
 
-// ==================== Tunnels ====================
+func serve() {
+	printHeader("☁️  CLOUDLAB SERVE")
+	ensureInstalled()
+	startAll()
+	supervise(10*time.Second, true)
+}
 
-func handleTunnel(action string) {
-	switch action {
-	case "start":
-		startAllTunnels()
-	case "stop":
-		stopAllTunnels()
-	case "restart":
-		stopAllTunnels()
-		time.Sleep(2 * time.Second)
-		startAllTunnels()
-	case "status":
-		showTunnelStatus()
-	default:
-		printError("Unknown: " + action)
+func ensureInstalled() {
+	if _, err := os.Stat(getJupyterPath()); err != nil && config.JupyterEnabled {
+		installJupyter()
+	}
+	if getVSCodePath() == "" && config.VSCodeEnabled {
+		installVSCode()
+	}
+	if bin, _ := terminalPath(); bin == "" && config.SSHEnabled {
+		installTerminal()
+	}
+	if _, err := exec.LookPath("cloudflared"); err != nil && config.TunnelEnabled {
+		installCloudflared()
+	}
+	if _, err := os.Stat(filepath.Join(cloudlabDir, "server.py")); err != nil {
+		createDashboardFiles()
 	}
 }
 
-func startAllTunnels() {
-	printStep("Starting Cloudflare tunnels...")
-
+// supervise blocks until SIGINT/SIGTERM, polling the running services and,
+// with restart set, starting crashed ones again.
+func supervise(interval time.Duration, restart bool) {
+	const maxRestarts = 5
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	starters := map[string]func(){}
+	var names []string
+	for _, svc := range services() {
+		name := svc.Name
+		starters[name] = svc.Start
+		starters[svc.TunnelName()] = func() { restartTunnel(name) }
+		names = append(names, name)
+	}
+	for _, svc := range services() {
+		names = append(names, svc.TunnelName())
+	}
+	mode := jupyterMode()
+	starters["jupyter"] = func() { startJupyter(mode) }
+	watched := []string{}
+	for _, name := range names {
+		if isRunning(name) {
+			watched = append(watched, name)
+			reap(name)
+		}
+	}
+	if !logEvent("info", "supervise_started", "", map[string]any{"watching": watched, "restart": restart}) {
+		printInfo(fmt.Sprintf("Running in foreground, watching %s. Press Ctrl+C to stop.", strings.Join(watched, ", ")))
+	}
+
+	restarts := map[string]int{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-sigs:
+			if !logEvent("info", "shutdown", "", map[string]any{"signal": sig.String()}) {
+				fmt.Printf("\n%s Received %s, shutting down\n", time.Now().Format("2006-01-02 15:04:05"), sig)
+			}
+			stopAll()
+			return
+		case <-ticker.C:
+			alive := watched[:0]
+			for _, name := range watched {
+				if isRunning(name) {
+					alive = append(alive, name)
+					continue
+				}
+				if !logEvent("warn", "service_exited", name, nil) {
+					printWarning(fmt.Sprintf("%s %s is no longer running (see: cloudlab logs %s)", time.Now().Format("2006-01-02 15:04:05"), name, name))
+				}
+				if !restart {
+					continue
+				}
+				if restarts[name] >= maxRestarts {
+					if !logEvent("error", "restart_abandoned", name, map[string]any{"restarts": restarts[name]}) {
+						printError(fmt.Sprintf("%s crashed %d times, giving up", name, restarts[name]))
+					}
+					continue
+				}
+				restarts[name]++
+				starters[name]()
+				if isRunning(name) {
+					reap(name)
+					alive = append(alive, name)
+					logEvent("info", "service_restarted", name, map[string]any{"pid": getPID(name), "restarts": restarts[name]})
+				}
+			}
+			watched = alive
+			if !logEvent("debug", "heartbeat", "", map[string]any{"running": len(watched)}) {
+				fmt.Printf("%s %d services running\n", time.Now().Format("2006-01-02 15:04:05"), len(watched))
+			}
+		}
+	}
+}
+
+func restartTunnel(name string) {
 	cf, err := exec.LookPath("cloudflared")
 	if err != nil {
-		printError("cloudflared not found. Run: cloudlab install cloudflare")
+		printErrorCode(codeNotInstalled, "cloudflared not found. Run: cloudlab install cloudflare")
 		return
 	}
+	if url := startTunnel(cf, name, servicePort(name)); url != "" {
+		if _, named := config.NamedTunnels[name]; named {
+			printSuccess(fmt.Sprintf("Reconnected %s tunnel: %s", name, url))
+		} else {
+			printSuccess(fmt.Sprintf("New %s tunnel: %s", name, url))
+		}
+	}
+}
+
+func servicePort(name string) int {
+	if svc := findService(name); svc != nil {
+		return svc.Port()
+	}
+	if t := findTerminal(name); t != nil {
+		return t.Port
+	}
+	return 0
+}
 
-	// Stop existing
-	stopPID("tunnel_jupyter")
-	stopPID("tunnel_vscode")
-	stopPID("tunnel_ssh")
-	stopPID("tunnel_dashboard")
-	time.Sleep(1 * time.Second)
+// logEvent writes a CloudLab lifecycle event (service started, tunnel URL,
+// crash, ...) as one JSON line when --log-format json is set. It reports
+// whether it did, so callers only print their usual text otherwise.
+func logEvent(level, event, service string, fields map[string]any) bool {
+	if logFormat != "json" {
+		return false
+	}
+	entry := map[string]any{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": level,
+		"event": event,
+	}
+	if service != "" {
+		entry["service"] = service
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	data, _ := json.Marshal(entry)
+	fmt.Println(string(data))
+	return true
+}
+
+// reap collects an exited child so it doesn't linger as a zombie that still
+// looks alive to isRunning while CloudLab stays in the foreground.
+func reap(name string) {
+	if p, err := os.FindProcess(getPID(name)); err == nil {
+		go p.Wait()
+	}
+}
+
+func startJupyter(mode string) {
+	// mode is the jupyter subcommand; a hand-edited config.json could hold anything.
+	if mode != "lab" && mode != "notebook" {
+		printErrorCode(codeInvalid, fmt.Sprintf("jupyter_mode must be lab or notebook, got %q. Run: cloudlab config set jupyter_mode lab", mode))
+		return
+	}
+	printStep("Starting Jupyter " + mode + "...")
+	jp := getJupyterPath()
+	if _, err := os.Stat(jp); err != nil {
+		printErrorCode(codeNotInstalled, "Jupyter not found. Run: cloudlab install jupyter")
+		return
+	}
+
+	stopPID("jupyter")
+	time.Sleep(500 * time.Millisecond)
+
+	app := "ServerApp"
+	if mode != "lab" {
+		app = "NotebookApp"
+	}
+	args := []string{mode, "--no-browser"}
+	if sock := config.JupyterSocket; sock != "" {
+		os.Remove(sock)
+		args = append(args, fmt.Sprintf("--%s.sock=%s", app, sock))
+	} else {
+		if !assignPort("Jupyter", &config.JupyterPort) || !checkPortAvailable("jupyter_port", config.JupyterPort) {
+			return
+		}
+		args = append(args, jupyterBindArgs(config.JupyterPort)...)
+	}
+	args = append(args, fmt.Sprintf("--notebook-dir=%s", config.WorkDir),
+		fmt.Sprintf("--%s.token=''", app), fmt.Sprintf("--%s.allow_origin='*'", app))
+	args = append(args, config.JupyterArgs...)
+	cmd := exec.Command(jp, args...)
+	cmd.Dir = config.WorkDir
+	u, ok := dropPrivileges(cmd)
+	if !ok {
+		return
+	}
+	if u != nil {
+		dir, ok := u.copyConfigTo("jupyter", filepath.Join(homeDir, ".jupyter", "jupyter_lab_config.py"), filepath.Join(homeDir, ".jupyter", "jupyter_server_config.py"))
+		if !ok {
+			return
+		}
+		cmd.Env = append(cmd.Env, "JUPYTER_CONFIG_DIR="+dir)
+	}
+
+	logPath := filepath.Join(cloudlabDir, "logs", "jupyter.log")
+	logFile, _ := os.Create(logPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	savePID("jupyter", cmd.Process.Pid)
+	os.WriteFile(jupyterModePath(), []byte(mode), 0644)
+	if sock := config.JupyterSocket; sock != "" {
+		if !waitReady("Jupyter", cmd, "unix", sock, logPath) {
+			return
+		}
+		if !logEvent("info", "service_started", "jupyter", map[string]any{"pid": cmd.Process.Pid, "socket": sock, "mode": mode}) {
+			fmt.Printf("  %s✓%s Jupyter %s on socket %s%s%s\n", BrightGreen, Reset, mode, BrightCyan, sock, Reset)
+		}
+		return
+	}
+	if !waitReady("Jupyter", cmd, "tcp", localAddr(config.JupyterPort), logPath) {
+		return
+	}
+	if !logEvent("info", "service_started", "jupyter", map[string]any{"pid": cmd.Process.Pid, "port": config.JupyterPort, "mode": mode}) {
+		fmt.Printf("  %s✓%s Jupyter %s on port %s%d%s\n", BrightGreen, Reset, mode, BrightCyan, config.JupyterPort, Reset)
+	}
+}
+
+// startViewer runs a second Jupyter on viewer_port that logs in with
+// viewer_password and only allows read actions: notebooks can be opened
+// but not edited, saved or run. It has its own config dir so the main
+// password in ~/.jupyter doesn't apply. code-server has no read-only mode,
+// so there's no VS Code equivalent.
+func startViewer() {
+	printStep("Starting Jupyter viewer...")
+	if config.ViewerPassword == "" {
+		printError("viewer_password not set. Run: cloudlab config set viewer_password <password>")
+		return
+	}
+	jp := getJupyterPath()
+	if _, err := os.Stat(jp); err != nil {
+		printErrorCode(codeNotInstalled, "Jupyter not found. Run: cloudlab install jupyter")
+		return
+	}
+	stopPID("viewer")
+	if !assignPort("Jupyter viewer", &config.ViewerPort) || !checkPortAvailable("viewer_port", config.ViewerPort) {
+		return
+	}
+
+	mode := config.JupyterMode
+	if mode != "notebook" {
+		mode = "lab"
+	}
+	// authorizer_class is also on the command line: if the config dir can't
+	// be read, Jupyter fails to start rather than running read-write.
+	cmd := exec.Command(jp, mode, "--no-browser", "--ServerApp.authorizer_class=cloudlab_viewer.ReadOnlyAuthorizer")
+	cmd.Dir = config.WorkDir
+	u, ok := dropPrivileges(cmd)
+	if !ok {
+		return
+	}
+	dir := filepath.Join(cloudlabDir, "viewer")
+	var err error
+	if u != nil {
+		dir, err = u.configDir("viewer")
+	} else {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = u.writeFile(filepath.Join(dir, "cloudlab_viewer.py"), []byte(`from jupyter_server.auth import Authorizer
+
+
+class ReadOnlyAuthorizer(Authorizer):
+    def is_authorized(self, handler, user, action, resource):
+        return action == "read"
+`))
+	}
+	var hash string
+	if err == nil {
+		hash, err = jupyterPasswordHash(config.ViewerPassword)
+	}
+	if err == nil {
+		err = u.writeFile(filepath.Join(dir, "jupyter_server_config.py"), []byte(fmt.Sprintf(`c = get_config()
+c.ServerApp.ip = '%s'
+c.ServerApp.port = %d
+c.ServerApp.open_browser = False
+c.ServerApp.allow_root = True
+c.ServerApp.root_dir = '%s'
+c.ServerApp.password = '%s'
+c.ServerApp.token = ''
+c.ServerApp.authorizer_class = 'cloudlab_viewer.ReadOnlyAuthorizer'
+`, bindAddress(), config.ViewerPort, config.WorkDir, hash)))
+	}
+	if err != nil {
+		printErrorCode(errCode(err), "Could not write the viewer config, not starting it: "+err.Error())
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "JUPYTER_CONFIG_DIR="+dir, "PYTHONPATH="+dir)
+	logPath := filepath.Join(cloudlabDir, "logs", "viewer.log")
+	logFile, _ := os.Create(logPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	savePID("viewer", cmd.Process.Pid)
+	if !waitReady("Jupyter viewer", cmd, "tcp", localAddr(config.ViewerPort), logPath) {
+		return
+	}
+	if !logEvent("info", "service_started", "viewer", map[string]any{"pid": cmd.Process.Pid, "port": config.ViewerPort}) {
+		fmt.Printf("  %s✓%s Jupyter viewer (read-only) on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.ViewerPort, Reset)
+	}
+}
+
+func jupyterModePath() string {
+	return filepath.Join(cloudlabDir, "pids", "jupyter.mode")
+}
+
+// jupyterMode is the mode Jupyter was actually started in, which differs
+// from jupyter_mode after an explicit "start lab" or "start notebook".
+func jupyterMode() string {
+	if isRunning("jupyter") {
+		if data, err := os.ReadFile(jupyterModePath()); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return config.JupyterMode
+}
+
+func startVSCode() {
+	printStep("Starting VS Code...")
+	cs := getVSCodePath()
+	if cs == "" {
+		printErrorCode(codeNotInstalled, "code-server not found. Run: cloudlab install vscode")
+		return
+	}
+
+	stopPID("vscode")
+	time.Sleep(500 * time.Millisecond)
+	if !assignPort("VS Code", &config.VSCodePort) || !checkPortAvailable("vscode_port", config.VSCodePort) {
+		return
+	}
+
+	args := append([]string{vscodeBindArg(config.VSCodePort), config.WorkDir}, config.VSCodeArgs...)
+	cmd := exec.Command(cs, args...)
+	cmd.Dir = config.WorkDir
+	u, ok := dropPrivileges(cmd)
+	if !ok {
+		return
+	}
+	if u != nil {
+		dir, ok := u.copyConfigTo("code-server", filepath.Join(homeDir, ".config", "code-server", "config.yaml"))
+		if !ok {
+			return
+		}
+		cmd.Args = append([]string{cmd.Args[0], "--config", filepath.Join(dir, "config.yaml")}, cmd.Args[1:]...)
+	}
+
+	logPath := filepath.Join(cloudlabDir, "logs", "vscode.log")
+	logFile, _ := os.Create(logPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	savePID("vscode", cmd.Process.Pid)
+	if !waitReady("VS Code", cmd, "tcp", localAddr(config.VSCodePort), logPath) {
+		return
+	}
+	if !logEvent("info", "service_started", "vscode", map[string]any{"pid": cmd.Process.Pid, "port": config.VSCodePort}) {
+		fmt.Printf("  %s✓%s VS Code on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.VSCodePort, Reset)
+	}
+}
+
+func startSSH() {
+	printStep("Starting SSH Terminal...")
+	if !assignPort("SSH Terminal", &config.SSHPort) {
+		return
+	}
+	if startTerminal("ssh", config.SSHPort, config.WorkDir) && !logEvent("info", "service_started", "ssh", map[string]any{"pid": getPID("ssh"), "port": config.SSHPort}) {
+		fmt.Printf("  %s✓%s SSH Terminal on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.SSHPort, Reset)
+	}
+}
+
+// terminalPath returns the web terminal binary for terminal_backend and its
+// name for error messages.
+func terminalPath() (string, string) {
+	switch config.TerminalBackend {
+	case "gotty":
+		return getGoTTYPath(), "gotty"
+	case "builtin":
+		return builtinTerminalPath(), "builtin"
+	}
+	p, _ := exec.LookPath("ttyd")
+	return p, "ttyd"
+}
+
+func startTerminal(name string, port int, dir string) bool {
+	bin, backend := terminalPath()
+	if bin == "" && backend != "builtin" {
+		printWarning(backend + " not found; using the built-in web terminal (cloudlab install ssh for the full one)")
+		bin, backend = builtinTerminalPath(), "builtin"
+	}
+	if bin == "" {
+		printErrorCode(codeNotInstalled, backend+" not found. Run: cloudlab install ssh")
+		return false
+	}
+	if name == "ssh" && !isLocalHost(config.SSHHost) {
+		if !checkSSHHost() {
+			printInfo("Not starting a local shell instead. Run: cloudlab config set ssh_host localhost")
+			return false
+		}
+		printInfo("Terminal will connect to " + config.SSHUser + "@" + config.SSHHost)
+	}
+
+	stopPID(name)
+	time.Sleep(500 * time.Millisecond)
+	key := "ssh_port"
+	if name != "ssh" {
+		key = name
+	}
+	if !checkPortAvailable(key, port) {
+		return false
+	}
+
+	args := terminalBindArgs(backend, port)
+	credential := ""
+	if config.SSHPassword != "" {
+		credential = fmt.Sprintf("%s:%s", config.SSHUser, config.SSHPassword)
+	}
+	var extraEnv []string
+	if backend == "builtin" {
+		args = append(args, "--")
+		if credential != "" {
+			extraEnv = append(extraEnv, webTerminalCredEnv+"="+credential)
+		}
+	} else if backend == "gotty" {
+		if credential != "" {
+			args = append(args, "-c", credential)
+		}
+	} else {
+		if credential != "" {
+			// ttyd prints the base64 credential as a startup notice, which would
+			// land in the log; keep only errors and warnings.
+			args = append(args, "--credential", credential, "--debug", "3")
+		}
+	}
+
+	if backend != "builtin" {
+		args = append(args, config.TerminalArgs...)
+	}
+	shellArgs, shellEnv := terminalCommand(name)
+	args = append(args, shellArgs...)
+	shellEnv = append(shellEnv, extraEnv...)
+
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	if shellEnv != nil {
+		cmd.Env = append(os.Environ(), shellEnv...)
+	}
+	if _, ok := dropPrivileges(cmd); !ok {
+		return false
+	}
+
+	logPath := filepath.Join(cloudlabDir, "logs", name+".log")
+	logFile, _ := os.Create(logPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return false
+	}
+	savePID(name, cmd.Process.Pid)
+	return waitReady("SSH Terminal", cmd, "tcp", localAddr(port), logPath)
+}
+
+const readyPollInterval = 250 * time.Millisecond
+
+func bindAddress() string {
+	if config.BindAddress == "" {
+		return "0.0.0.0"
+	}
+	return config.BindAddress
+}
+
+// localAddr is how CloudLab itself (health checks, tunnels) reaches a
+// service bound to bind_address: loopback of the same family for wildcard
+// binds, the address itself otherwise.
+func localAddr(port int) string {
+	host := "127.0.0.1"
+	if ip := net.ParseIP(bindAddress()); ip != nil {
+		switch {
+		case !ip.IsUnspecified():
+			host = ip.String()
+		case ip.To4() == nil:
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// waitReady polls until the service accepts connections on addr, giving up
+// after startup_timeout seconds or as soon as the process exits.
+func waitReady(label string, cmd *exec.Cmd, network, addr, logPath string) bool {
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	timeout := time.Duration(config.StartupTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if conn, err := net.DialTimeout(network, addr, readyPollInterval); err == nil {
+			conn.Close()
+			return true
+		}
+		select {
+		case <-exited:
+			printError(fmt.Sprintf("%s exited during startup; see %s", label, logPath))
+			return false
+		case <-rootCtx.Done():
+			printErrorCode(codeTimeout, fmt.Sprintf("Deadline reached while waiting for %s; see %s", label, logPath))
+			return false
+		case <-time.After(readyPollInterval):
+		}
+	}
+	printErrorCode(codeTimeout, fmt.Sprintf("Timed out waiting for %s to become ready after %s; see %s", label, timeout, logPath))
+	return false
+}
+
+func startDashboard() {
+	printStep("Starting Dashboard...")
+
+	py := envPython(envPath("cloudlab"))
+	if _, err := os.Stat(py); err != nil {
+		py = "python3"
+		if _, err := exec.LookPath(py); err != nil {
+			py = "python"
+		}
+	}
+
+	stopPID("dashboard")
+	time.Sleep(500 * time.Millisecond)
+	if !assignPort("Dashboard", &config.DashboardPort) || !checkPortAvailable("dashboard_port", config.DashboardPort) {
+		return
+	}
+
+	// Copy latest dashboard.html
+	if _, err := os.Stat("index.html"); err == nil {
+		data, _ := os.ReadFile("index.html")
+		os.WriteFile(filepath.Join(cloudlabDir, "dashboard.html"), data, 0644)
+	}
+
+	serverPath := filepath.Join(cloudlabDir, "server.py")
+	if _, err := os.Stat(serverPath); err != nil {
+		createDashboardFiles()
+	}
+
+	cmd := exec.Command(py, serverPath)
+	cmd.Dir = cloudlabDir
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("CLOUDLAB_PORT=%d", config.DashboardPort),
+		"CLOUDLAB_BIND="+bindAddress(),
+		"CLOUDLAB_DIR="+cloudlabDir,
+		"CLOUDLAB_CONFIG="+configPath)
+
+	logFile, _ := os.Create(filepath.Join(cloudlabDir, "logs", "dashboard.log"))
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	savePID("dashboard", cmd.Process.Pid)
+	if !logEvent("info", "service_started", "dashboard", map[string]any{"pid": cmd.Process.Pid, "port": config.DashboardPort}) {
+		fmt.Printf("  %s✓%s Dashboard on port %s%d%s\n", BrightGreen, Reset, BrightCyan, config.DashboardPort, Reset)
+	}
+}
+
+func stopService(s string) {
+	switch s {
+	case "all":
+		stopAll()
+		return
+	case "tunnel", "tunnels":
+		stopAllTunnels()
+		return
+	}
+	if svc := findService(s); svc != nil {
+		svc.Stop()
+		printSuccess(svc.Label + " stopped")
+		return
+	}
+	if names := resolveService(s); strings.HasPrefix(names[0], "tunnel_") && isRunning(names[0]) {
+		stopTunnel(strings.TrimPrefix(names[0], "tunnel_"))
+		return
+	}
+	printErrorCode(codeUnknown, "Unknown: "+s)
+}
+
+func stopAll() {
+	printHeader("🛑 STOPPING ALL")
+	if config.TunnelEnabled {
+		stopAllTunnels()
+	}
+	for _, t := range config.Terminals {
+		stopPID(t.pidName())
+	}
+	for _, svc := range services() {
+		if svc.Enabled() {
+			svc.Stop()
+		}
+	}
+	printSuccess("All stopped")
+}
+
+// ==================== Resume ====================
+
+// resume restarts whatever was running before the last reboot or crash:
+// services, named terminals and the idle monitor first, then their tunnels.
+// Without last_running.json (older versions) the leftover pid files say
+// what was running instead.
+func resume() {
+	printHeader("🔁 RESUME")
+	set, ok := loadLastRunning()
+	if !ok {
+		entries, _ := os.ReadDir(filepath.Join(cloudlabDir, "pids"))
+		for _, e := range entries {
+			if name, ok := strings.CutSuffix(e.Name(), ".pid"); ok {
+				set[name] = true
+			}
+		}
+	}
+	if len(set) == 0 {
+		printInfo("Nothing was running. Run: cloudlab start all")
+		return
+	}
+
+	started := 0
+	for _, svc := range services() {
+		switch {
+		case !set[svc.Name]:
+		case isRunning(svc.Name):
+			printInfo(svc.Label + " is already running")
+		case !svc.Enabled():
+			printInfo(svc.Label + " is disabled; skipping")
+		default:
+			svc.Start()
+			started++
+		}
+	}
+	for _, t := range config.Terminals {
+		if set[t.pidName()] && !isRunning(t.pidName()) {
+			startNamedTerminal(t.Name, "", "", false)
+			started++
+		}
+	}
+	if set["idle"] && !isRunning("idle") {
+		startIdleMonitor()
+		started++
+	}
+
+	tunnels := 0
+	for _, name := range serviceNames() {
+		target, _ := tunnelTarget(name)
+		if !strings.HasPrefix(name, "tunnel_") || !set[name] || isRunning(name) || !isRunning(target) {
+			continue
+		}
+		startOneTunnel(target)
+		tunnels++
+	}
+	if started == 0 && tunnels == 0 {
+		printSuccess("Everything that was running still is")
+		return
+	}
+	if tunnels > 0 {
+		loadConfig()
+		showTunnelStatus()
+		if config.NotifyOnStart && emailReady() {
+			sendTunnelEmail()
+		}
+	}
+}
+
+// ==================== Tunnels ====================
+
+func handleTunnel(args []string) {
+	action := args[0]
+	keepURLsFlag = hasFlag(args, "--keep-urls")
+	if f := flagValue(args, "--quick-timeout"); f != "" {
+		d, err := time.ParseDuration(f)
+		if n, nerr := strconv.Atoi(f); nerr == nil {
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d <= 0 {
+			printErrorCode(codeInvalid, "--quick-timeout must be a duration like 20s or a number of seconds")
+			return
+		}
+		tunnelWait = d
+	}
+	if names := positional(args[1:], "--quick-timeout"); len(names) > 0 && (action == "start" || action == "stop" || action == "restart") {
+		name, ok := tunnelTarget(names[0])
+		if !ok {
+			printErrorCode(codeNotFound, "Unknown service: "+names[0])
+			return
+		}
+		if action != "start" {
+			stopTunnel(name)
+		}
+		if action != "stop" {
+			startOneTunnel(name)
+		}
+		return
+	}
+	switch action {
+	case "start":
+		startAllTunnels()
+	case "stop":
+		stopAllTunnels()
+	case "restart":
+		stopAllTunnels()
+		time.Sleep(2 * time.Second)
+		startAllTunnels()
+	case "status":
+		showTunnelStatus()
+	case "metrics":
+		showTunnelMetrics()
+	case "history":
+		showTunnelHistory()
+	case "named":
+		handleNamedTunnel(args[1:])
+	case "test":
+		name := ""
+		if names := positional(args[1:]); len(names) > 0 {
+			var ok bool
+			if name, ok = tunnelTarget(names[0]); !ok {
+				printErrorCode(codeNotFound, "Unknown service: "+names[0])
+				return
+			}
+		}
+		exit(testTunnels(name))
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+action)
+	}
+}
+
+// handleNamedTunnel maps a service to a named tunnel:
+// tunnel named <service> <tunnel> <hostname>, or <service> none to go back
+// to quick tunnels. Without arguments it lists the mappings.
+func handleNamedTunnel(args []string) {
+	if len(args) == 0 {
+		printHeader("🌐 NAMED TUNNELS")
+		if len(config.NamedTunnels) == 0 {
+			printInfo("None; every service uses a quick tunnel")
+		}
+		names := make([]string, 0, len(config.NamedTunnels))
+		for name := range config.NamedTunnels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			nt := config.NamedTunnels[name]
+			fmt.Printf("  %-12s %s → %shttps://%s%s\n", name, nt.Tunnel, BrightMagenta, nt.Hostname, Reset)
+		}
+		fmt.Println()
+		return
+	}
+	name, ok := tunnelTarget(args[0])
+	if !ok {
+		printErrorCode(codeNotFound, "Unknown service: "+args[0])
+		return
+	}
+	if len(args) == 2 && args[1] == "none" {
+		delete(config.NamedTunnels, name)
+		saveConfig()
+		printSuccess(name + " uses a quick tunnel again")
+		return
+	}
+	if len(args) < 3 {
+		printErrorCode(codeUsage, "Usage: cloudlab tunnel named <service> <tunnel> <hostname> | <service> none")
+		return
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(args[2], "https://"), "/")
+	if !hostnameRe.MatchString(host) {
+		printErrorCode(codeInvalid, "Invalid hostname: "+args[2])
+		return
+	}
+	if config.NamedTunnels == nil {
+		config.NamedTunnels = map[string]NamedTunnel{}
+	}
+	config.NamedTunnels[name] = NamedTunnel{Tunnel: args[1], Hostname: host}
+	saveConfig()
+	printSuccess(fmt.Sprintf("%s will use tunnel %s at https://%s", name, args[1], host))
+	printInfo("Route the hostname first: cloudflared tunnel route dns " + args[1] + " " + host)
+}
+
+// tunnelTarget maps a service name or alias, optionally prefixed with
+// "tunnel_", or a named terminal's ssh_<name> to the name its tunnel uses.
+func tunnelTarget(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "tunnel_")
+	if svc := findService(name); svc != nil {
+		return svc.Name, true
+	}
+	if findTerminal(name) != nil {
+		return name, true
+	}
+	return "", false
+}
+
+func startOneTunnel(name string) {
+	if !isRunning(name) {
+		start := "cloudlab start " + name
+		if t := findTerminal(name); t != nil {
+			start = "cloudlab ssh start " + t.Name
+		}
+		printError(fmt.Sprintf("%s is not running. Start it first: %s", name, start))
+		return
+	}
+	printStep("Starting " + name + " tunnel...")
+	stopPID("tunnel_" + name)
+	restartTunnel(name)
+}
+
+// testTunnels requests each stored tunnel URL (or just name's) from the
+// outside and reports status and round-trip time. Any HTTP answer below
+// 500 counts: a login page still proves the tunnel reaches the service,
+// while Cloudflare answers 502/530 itself when the origin is unreachable.
+func testTunnels(name string) int {
+	printHeader("🌐 TUNNEL TEST")
+	type target struct{ name, url string }
+	var targets []target
+	for _, svc := range services() {
+		targets = append(targets, target{svc.Name, *svc.URL()})
+	}
+	for _, t := range config.Terminals {
+		if t.Tunnel {
+			targets = append(targets, target{t.pidName(), t.TunnelURL})
+		}
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	failed, tested := 0, 0
+	for _, t := range targets {
+		if name != "" && t.name != name {
+			continue
+		}
+		if t.url == "" {
+			if name != "" {
+				printError(t.name + " has no tunnel URL. Run: cloudlab tunnel start " + t.name)
+				return 1
+			}
+			continue
+		}
+		tested++
+		req, err := http.NewRequestWithContext(rootCtx, "GET", t.url, nil)
+		if err != nil {
+			printErrorCode(errCode(err), t.name+": "+err.Error())
+			failed++
+			continue
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		rtt := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Printf("  %s✗%s %-12s %s\n    └─ %s%v%s\n", BrightRed, Reset, t.name, t.url, Dim, err, Reset)
+			failed++
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			fmt.Printf("  %s✗%s %-12s %s %s%d%s in %s\n", BrightRed, Reset, t.name, t.url, BrightRed, resp.StatusCode, Reset, rtt)
+			failed++
+			continue
+		}
+		fmt.Printf("  %s✓%s %-12s %s %s%d%s in %s\n", BrightGreen, Reset, t.name, t.url, BrightGreen, resp.StatusCode, Reset, rtt)
+	}
+	fmt.Println()
+	switch {
+	case tested == 0:
+		printWarning("No tunnel URLs to test. Run: cloudlab tunnel start")
+	case failed > 0:
+		printError(fmt.Sprintf("%d of %d tunnels not reachable. Check: cloudlab logs tunnel_<service>", failed, tested))
+		return 1
+	default:
+		printSuccess(fmt.Sprintf("All %d tunnels reachable", tested))
+	}
+	return 0
+}
+
+func stopTunnel(name string) {
+	if endTunnel(name) {
+		saveConfig()
+	}
+	printSuccess(name + " tunnel stopped")
+}
+
+// endTunnel stops one tunnel, giving cloudflared tunnel_grace_period to
+// finish in-flight requests, and forgets its URL unless --keep-urls was
+// given. It reports whether the config changed.
+func endTunnel(name string) bool {
+	running := isRunning("tunnel_" + name)
+	stopPIDWithin("tunnel_"+name, tunnelGrace())
+	if !running || keepURLsFlag {
+		return false
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	if svc := findService(name); svc != nil {
+		*svc.URL() = ""
+	} else if t := findTerminal(name); t != nil {
+		t.TunnelURL = ""
+	}
+	return true
+}
+
+func tunnelGrace() time.Duration {
+	if config.TunnelGrace > 0 {
+		return time.Duration(config.TunnelGrace)*time.Second + time.Second
+	}
+	return 500 * time.Millisecond
+}
+
+func startAllTunnels() {
+	printStep("Starting Cloudflare tunnels...")
+
+	cf, err := exec.LookPath("cloudflared")
+	if err != nil {
+		printErrorCode(codeNotInstalled, "cloudflared not found. Run: cloudlab install cloudflare")
+		return
+	}
+
+	// Stop existing
+	for _, svc := range services() {
+		stopPID(svc.TunnelName())
+	}
+	time.Sleep(1 * time.Second)
+
+	// Start tunnels
+	type target struct {
+		name string
+		port int
+	}
+	var targets []target
+	for _, svc := range services() {
+		if isRunning(svc.Name) || svc.Name == "dashboard" {
+			targets = append(targets, target{svc.Name, svc.Port()})
+		}
+	}
+	for _, t := range config.Terminals {
+		if t.Tunnel && isRunning(t.pidName()) {
+			targets = append(targets, target{t.pidName(), t.Port})
+		}
+	}
+
+	fmt.Printf("  %s⏳%s Waiting for tunnel URLs...\n", BrightYellow, Reset)
+	history := loadTunnelHistory()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	changed := false
+	for _, t := range targets {
+		wg.Add(1)
+		go func(name string, port int) {
+			defer wg.Done()
+			url := startTunnel(cf, name, port)
+			if entries := history[name]; url != "" && (len(entries) == 0 || entries[len(entries)-1].URL != url) {
+				mu.Lock()
+				changed = true
+				mu.Unlock()
+			}
+		}(t.name, t.port)
+	}
+	wg.Wait()
+
+	loadConfig()
+	showTunnelStatus()
+
+	if config.NotifyOnStart && emailReady() {
+		if changed {
+			sendTunnelEmail()
+		} else {
+			printInfo("Tunnel URLs unchanged; not emailing them again")
+		}
+	}
+}
+
+func startTunnel(cf, name string, port int) string {
+	logPath := filepath.Join(cloudlabDir, "logs", "tunnel_"+name+".log")
+	for attempt := 1; attempt <= tunnelAttempts; attempt++ {
+		if attempt > 1 {
+			if !logEvent("warn", "tunnel_retry", "tunnel_"+name, map[string]any{"attempt": attempt, "max_attempts": tunnelAttempts}) {
+				printWarning(fmt.Sprintf("No URL for %s tunnel yet, retrying (%d/%d)...", name, attempt, tunnelAttempts))
+			}
+			time.Sleep(time.Duration(attempt*2) * time.Second)
+		}
+		url, err := launchTunnel(cf, name, port, logPath)
+		if url != "" {
+			logEvent("info", "tunnel_url", "tunnel_"+name, map[string]any{"pid": getPID("tunnel_" + name), "url": url})
+			return url
+		}
+		if err != nil {
+			// cloudflared gave up on its own; another attempt won't go better.
+			stopPID("tunnel_" + name)
+			if !logEvent("error", "tunnel_failed", "tunnel_"+name, map[string]any{"error": err.Error(), "log": logPath}) {
+				printError(fmt.Sprintf("%s tunnel failed: %v. See: %s", name, err, logPath))
+			}
+			return ""
+		}
+	}
+	stopPID("tunnel_" + name)
+	if !logEvent("error", "tunnel_failed", "tunnel_"+name, map[string]any{"attempts": tunnelAttempts, "log": logPath}) {
+		printError(fmt.Sprintf("No URL for %s tunnel after %d attempts. See: %s", name, tunnelAttempts, logPath))
+	}
+	return ""
+}
+
+func launchTunnel(cf, name string, port int, logPath string) (string, error) {
+	stopPID("tunnel_" + name)
+	logFile, _ := os.Create(logPath)
+	defer logFile.Close()
+	args := []string{"tunnel"}
+	if mp, err := freePort(); err == nil {
+		args = append(args, "--metrics", fmt.Sprintf("localhost:%d", mp))
+		os.WriteFile(metricsPath(name), []byte(strconv.Itoa(mp)), 0644)
+	}
+	if config.TunnelProtocol != "" {
+		args = append(args, "--protocol", config.TunnelProtocol)
+	}
+	if config.TunnelRegion != "" {
+		args = append(args, "--region", config.TunnelRegion)
+	}
+	if config.TunnelGrace > 0 {
+		args = append(args, "--grace-period", fmt.Sprintf("%ds", config.TunnelGrace))
+	}
+	if name == "jupyter" && config.JupyterSocket != "" {
+		args = append(args, "--unix-socket", config.JupyterSocket)
+	} else {
+		args = append(args, "--url", "http://"+localAddr(port))
+	}
+	nt, named := config.NamedTunnels[name]
+	if named {
+		args = append(args, "run", nt.Tunnel)
+	}
+	cmd := exec.Command(cf, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	savePID("tunnel_"+name, cmd.Process.Pid)
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	if named && config.TunnelPattern == "" {
+		return extractURL(name, logPath, exited, func(log string) string {
+			// The hostname is fixed; it's live once an edge connection registers.
+			if strings.Contains(log, "Registered tunnel connection") {
+				return "https://" + nt.Hostname
+			}
+			return ""
+		})
+	}
+	return extractURL(name, logPath, exited, tunnelURLFromLog)
+}
+
+// tunnelURLRe finds the public URL cloudflared logs for a quick tunnel, or
+// the <uuid>.cfargotunnel.com address some setups print instead.
+// tunnel_url_pattern replaces it, e.g. for a custom domain.
+var tunnelURLRe = regexp.MustCompile(`https://[a-zA-Z0-9-]+\.(?:trycloudflare|cfargotunnel)\.com`)
+
+func tunnelURLFromLog(log string) string {
+	re := tunnelURLRe
+	if config.TunnelPattern != "" {
+		if custom, err := regexp.Compile(config.TunnelPattern); err == nil {
+			re = custom
+		}
+	}
+	var matches []string
+	for _, m := range re.FindAllString(log, -1) {
+		// cloudflared's own API shows up in its error messages.
+		if !strings.Contains(m, "api.trycloudflare.com") {
+			matches = append(matches, m)
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+	url := matches[len(matches)-1]
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
+	}
+	return url
+}
+
+// tunnelFatalRe matches cloudflared errors that mean no URL is coming, so
+// extractURL can stop waiting before tunnelWait runs out.
+var tunnelFatalRe = regexp.MustCompile(`(?i)[^\n]*(failed to request quick tunnel|cannot determine default origin certificate|credentials file .* doesn't exist|error parsing tunnel id)[^\n]*`)
+
+// lastLogLine returns the last ERR line of a cloudflared log, or the last line.
+func lastLogLine(log string) string {
+	lines := strings.Split(strings.TrimSpace(log), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.Contains(lines[i], " ERR ") {
+			return strings.TrimSpace(lines[i])
+		}
+	}
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// extractURL waits up to tunnelWait for match to find the tunnel's URL in its
+// log and stores it. It returns an error as soon as cloudflared exits or logs
+// a fatal error; a plain timeout returns "" and no error.
+func extractURL(name, logPath string, exited <-chan error, match func(log string) string) (string, error) {
+	shown := 0
+	for deadline := time.Now().Add(tunnelWait); time.Now().Before(deadline); {
+		var done bool
+		var exitErr error
+		select {
+		case exitErr = <-exited:
+			done = true
+		default:
+		}
+		data, err := os.ReadFile(logPath)
+		if err == nil {
+			if verboseFlag {
+				if end := strings.LastIndexByte(string(data), '\n') + 1; end > shown {
+					for _, line := range strings.Split(strings.TrimSuffix(string(data[shown:end]), "\n"), "\n") {
+						fmt.Printf("  %s[tunnel_%s]%s %s\n", Dim, name, Reset, line)
+					}
+					shown = end
+				}
+			}
+			if fatal := tunnelFatalRe.FindString(string(data)); fatal != "" {
+				return "", errors.New(strings.TrimSpace(fatal))
+			}
+			if url := match(string(data)); url != "" {
+				configMu.Lock()
+				if svc := findService(name); svc != nil {
+					*svc.URL() = url
+				} else if t := findTerminal(name); t != nil {
+					t.TunnelURL = url
+				}
+				saveConfig()
+				recordTunnelURL(name, url)
+				configMu.Unlock()
+				return url, nil
+			}
+		}
+		if done {
+			msg := "cloudflared exited"
+			if exitErr != nil {
+				msg += " (" + exitErr.Error() + ")"
+			}
+			if len(strings.TrimSpace(string(data))) > 0 {
+				msg += ": " + lastLogLine(string(data))
+			}
+			return "", errors.New(msg)
+		}
+		if !sleepCtx(1 * time.Second) {
+			break
+		}
+	}
+	return "", nil
+}
+
+type TunnelHistoryEntry struct {
+	URL  string    `json:"url"`
+	Time time.Time `json:"time"`
+}
+
+const tunnelHistorySize = 10
+
+func tunnelHistoryPath() string {
+	return filepath.Join(cloudlabDir, "tunnel_history.json")
+}
+
+func loadTunnelHistory() map[string][]TunnelHistoryEntry {
+	history := map[string][]TunnelHistoryEntry{}
+	if data, err := os.ReadFile(tunnelHistoryPath()); err == nil {
+		json.Unmarshal(data, &history)
+	}
+	return history
+}
+
+func recordTunnelURL(name, url string) {
+	history := loadTunnelHistory()
+	entries := history[name]
+	if len(entries) > 0 && entries[len(entries)-1].URL == url {
+		return
+	}
+	entries = append(entries, TunnelHistoryEntry{URL: url, Time: time.Now()})
+	if len(entries) > tunnelHistorySize {
+		entries = entries[len(entries)-tunnelHistorySize:]
+	}
+	history[name] = entries
+	data, _ := json.MarshalIndent(history, "", "  ")
+	os.WriteFile(tunnelHistoryPath(), data, 0600)
+}
+
+func showTunnelHistory() {
+	printHeader("🕘 TUNNEL HISTORY")
+	history := loadTunnelHistory()
+	if len(history) == 0 {
+		printInfo("No tunnel URLs recorded yet")
+		fmt.Println()
+		return
+	}
+	names := make([]string, 0, len(history))
+	for name := range history {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s%s%s\n", Bold, name, Reset)
+		entries := history[name]
+		for i := len(entries) - 1; i >= 0; i-- {
+			fmt.Printf("    %s%s%s  %s\n", Dim, entries[i].Time.Format("2006-01-02 15:04:05"), Reset, entries[i].URL)
+		}
+	}
+	fmt.Println()
+}
+
+func stopAllTunnels() {
+	var names []string
+	for _, svc := range services() {
+		names = append(names, svc.Name)
+	}
+	for _, t := range config.Terminals {
+		names = append(names, t.pidName())
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	changed := false
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if endTunnel(name) {
+				mu.Lock()
+				changed = true
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	if changed {
+		saveConfig()
+	}
+	printSuccess("Tunnels stopped")
+}
+
+func showTunnelStatus() {
+	loadConfig()
+	printHeader("🌐 TUNNEL URLS")
+
+	for _, svc := range services() {
+		printTunnelLine(svc.Icon+" "+svc.Label, svc.Name, *svc.URL())
+	}
+	for _, t := range config.Terminals {
+		if t.Tunnel {
+			printTunnelLine("🔒 "+t.Name, t.pidName(), t.TunnelURL)
+		}
+	}
+	fmt.Println()
+}
+
+func printTunnelLine(label, name, url string) {
+	running := isRunning("tunnel_" + name)
+	status := fmt.Sprintf("%s[Stopped]%s", BrightRed, Reset)
+	if running {
+		status = fmt.Sprintf("%s[Running]%s", BrightGreen, Reset)
+	}
+	if url != "" {
+		fmt.Printf("  %-12s %s\n", label, status)
+		fmt.Printf("    └─ %s%s%s\n", BrightMagenta+Underline, url, Reset)
+	} else {
+		fmt.Printf("  %-12s %s %s(no tunnel)%s\n", label, status, Dim, Reset)
+	}
+	if running {
+		if m, err := scrapeTunnelMetrics(name); err == nil {
+			fmt.Printf("    └─ %s%.0f requests, %.0f active, %.0f edge connections%s\n", Dim, m.Requests, m.Concurrent, m.Connections, Reset)
+		}
+	}
+}
+
+type tunnelMetrics struct {
+	Requests    float64
+	Errors      float64
+	Concurrent  float64
+	Connections float64
+}
+
+func metricsPath(name string) string {
+	return filepath.Join(cloudlabDir, "pids", "tunnel_"+name+".metrics")
+}
+
+func scrapeTunnelMetrics(name string) (*tunnelMetrics, error) {
+	data, err := os.ReadFile(metricsPath(name))
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/metrics", strings.TrimSpace(string(data))))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	m := &tunnelMetrics{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		metric := fields[0]
+		if i := strings.Index(metric, "{"); i >= 0 {
+			metric = metric[:i]
+		}
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			continue
+		}
+		switch metric {
+		case "cloudflared_tunnel_total_requests":
+			m.Requests += v
+		case "cloudflared_tunnel_request_errors":
+			m.Errors += v
+		case "cloudflared_tunnel_concurrent_requests_per_tunnel":
+			m.Concurrent += v
+		case "cloudflared_tunnel_ha_connections":
+			m.Connections += v
+		}
+	}
+	return m, scanner.Err()
+}
+
+func showTunnelMetrics() {
+	loadConfig()
+	printHeader("📈 TUNNEL METRICS")
+	type tunnel struct {
+		label string
+		name  string
+	}
+	var tunnels []tunnel
+	for _, svc := range services() {
+		tunnels = append(tunnels, tunnel{svc.Icon + " " + svc.Label, svc.Name})
+	}
+	for _, t := range config.Terminals {
+		if t.Tunnel {
+			tunnels = append(tunnels, tunnel{"🔒 " + t.Name, t.pidName()})
+		}
+	}
+	fmt.Printf("  %-14s %10s %8s %8s %6s\n", "", "requests", "errors", "active", "edge")
+	for _, t := range tunnels {
+		if !isRunning("tunnel_" + t.name) {
+			fmt.Printf("  %-12s %s[Stopped]%s\n", t.label, BrightRed, Reset)
+			continue
+		}
+		m, err := scrapeTunnelMetrics(t.name)
+		if err != nil {
+			fmt.Printf("  %-12s %s(metrics unavailable)%s\n", t.label, Dim, Reset)
+			continue
+		}
+		fmt.Printf("  %-12s %s%10.0f%s %8.0f %8.0f %6.0f\n", t.label, BrightCyan, m.Requests, Reset, m.Errors, m.Concurrent, m.Connections)
+	}
+	fmt.Println()
+}
+
+// ==================== SSH ====================
+
+func handleSSH(args []string) {
+	names := positional(args[1:], "--dir", "--port")
+	switch args[0] {
+	case "start":
+		if len(names) == 0 {
+			startSSH()
+			return
+		}
+		startNamedTerminal(names[0], flagValue(args, "--dir"), flagValue(args, "--port"), hasFlag(args, "--tunnel"))
+	case "stop":
+		if len(names) == 0 {
+			stopPID("ssh")
+			printSuccess("SSH stopped")
+			return
+		}
+		t := findTerminal("ssh_" + names[0])
+		if t == nil {
+			printErrorCode(codeNotFound, "Unknown terminal: "+names[0])
+			return
+		}
+		stopPID("tunnel_" + t.pidName())
+		stopPID(t.pidName())
+		printSuccess("Terminal " + t.Name + " stopped")
+	case "remove", "rm":
+		if len(names) == 0 {
+			printErrorCode(codeUsage, "Usage: cloudlab ssh remove <name>")
+			return
+		}
+		removeTerminal(names[0])
+	case "config":
+		configureSSH()
+	case "status":
+		showSSHStatus()
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+args[0])
+	}
+}
+
+func (t Terminal) pidName() string {
+	return "ssh_" + t.Name
+}
+
+func findTerminal(pidName string) *Terminal {
+	for i := range config.Terminals {
+		if config.Terminals[i].pidName() == pidName {
+			return &config.Terminals[i]
+		}
+	}
+	return nil
+}
+
+func startNamedTerminal(name, dir, port string, tunnel bool) {
+	if !regexp.MustCompile(`^[a-zA-Z0-9_-]+$`).MatchString(name) {
+		printErrorCode(codeInvalid, "Terminal names may only contain letters, digits, - and _")
+		return
+	}
+	t := findTerminal("ssh_" + name)
+	if t == nil {
+		config.Terminals = append(config.Terminals, Terminal{Name: name, Dir: config.WorkDir})
+		t = &config.Terminals[len(config.Terminals)-1]
+	}
+	if dir != "" {
+		dir = expandPath(dir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			printErrorCode(codeNotFound, "Directory not found: "+dir)
+			return
+		}
+		t.Dir = dir
+	}
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			printErrorCode(codeInvalid, "Invalid port: "+port)
+			return
+		}
+		t.Port = p
+	}
+	if t.Port == 0 {
+		t.Port = nextTerminalPort()
+	}
+	if tunnel {
+		t.Tunnel = true
+	}
+	saveConfig()
+
+	printStep("Starting terminal " + t.Name + "...")
+	if !startTerminal(t.pidName(), t.Port, t.Dir) {
+		return
+	}
+	if !logEvent("info", "service_started", t.pidName(), map[string]any{"pid": getPID(t.pidName()), "port": t.Port, "dir": t.Dir}) {
+		fmt.Printf("  %s✓%s Terminal %s on port %s%d%s (%s)\n", BrightGreen, Reset, t.Name, BrightCyan, t.Port, Reset, t.Dir)
+	}
+
+	if t.Tunnel {
+		cf, err := exec.LookPath("cloudflared")
+		if err != nil {
+			printErrorCode(codeNotInstalled, "cloudflared not found. Run: cloudlab install cloudflare")
+			return
+		}
+		fmt.Printf("  %s⏳%s Waiting for tunnel URL...\n", BrightYellow, Reset)
+		if url := startTunnel(cf, t.pidName(), t.Port); url != "" {
+			fmt.Printf("    └─ %s%s%s\n", BrightMagenta, url, Reset)
+		}
+	}
+}
+
+func nextTerminalPort() int {
+	port := config.SSHPort + 1
+	for {
+		used := port == config.JupyterPort || port == config.VSCodePort || port == config.DashboardPort
+		for _, t := range config.Terminals {
+			if t.Port == port {
+				used = true
+			}
+		}
+		if !used {
+			return port
+		}
+		port++
+	}
+}
+
+func removeTerminal(name string) {
+	for i, t := range config.Terminals {
+		if t.Name == name {
+			stopPID("tunnel_" + t.pidName())
+			stopPID(t.pidName())
+			config.Terminals = append(config.Terminals[:i], config.Terminals[i+1:]...)
+			saveConfig()
+			printSuccess("Terminal " + name + " removed")
+			return
+		}
+	}
+	printErrorCode(codeNotFound, "Unknown terminal: "+name)
+}
+
+func configureSSH() {
+	printHeader("🔒 SSH CONFIG")
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("  SSH port [%d]: ", config.SSHPort)
+	if input := readLine(reader); input != "" {
+		setPort(input, &config.SSHPort)
+	}
+
+	fmt.Printf("  SSH username [%s]: ", config.SSHUser)
+	if input := readLine(reader); input != "" {
+		config.SSHUser = input
+	}
+
+	fmt.Printf("  SSH password (optional): ")
+	if input := readLine(reader); input != "" && checkPassword("ssh_password", input) {
+		config.SSHPassword = input
+	}
+
+	saveConfig()
+	printSuccess("SSH configured")
+}
+
+func isLocalHost(host string) bool {
+	switch host {
+	case "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// splitSSHHost splits an ssh_host value into host and port, defaulting to 22.
+func splitSSHHost(s string) (string, string) {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return host, port
+	}
+	return strings.Trim(s, "[]"), "22"
+}
+
+func hasSSHKey() bool {
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		return true
+	}
+	for _, key := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		if _, err := os.Stat(filepath.Join(homeDir, ".ssh", key)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSSHHost verifies ssh_host accepts connections and that the terminal
+// will be able to log in without someone typing at the ttyd prompt.
+func checkSSHHost() bool {
+	host, port := splitSSHHost(config.SSHHost)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+	if err != nil {
+		printError(fmt.Sprintf("ssh_host %s is not reachable on port %s: %v", host, port, err))
+		return false
+	}
+	conn.Close()
+	if _, err := exec.LookPath("ssh"); err != nil {
+		printErrorCode(codeNotInstalled, "ssh client not found; install OpenSSH to reach "+host)
+		return false
+	}
+	_, sshpassErr := exec.LookPath("sshpass")
+	switch {
+	case config.SSHPassword != "" && sshpassErr != nil && !hasSSHKey():
+		printWarning("sshpass isn't installed and no SSH key was found; the terminal will ask for the password on " + host)
+	case config.SSHPassword == "" && !hasSSHKey():
+		printWarning("No SSH key or ssh_password configured; the terminal will ask for credentials on " + host)
+	}
+	return true
+}
+
+// terminalCommand is the program the web terminal runs: a local login shell,
+// or ssh to ssh_host when one is configured.
+func terminalCommand(name string) ([]string, []string) {
+	host, port := splitSSHHost(config.SSHHost)
+	if name != "ssh" || isLocalHost(host) {
+		shell := "bash"
+		if runtime.GOOS == "windows" {
+			shell = "cmd.exe"
+		}
+		return []string{shell, "-l"}, nil
+	}
+	args := []string{"ssh", "-p", port, "-o", "StrictHostKeyChecking=accept-new", config.SSHUser + "@" + host}
+	if _, err := exec.LookPath("sshpass"); err == nil && config.SSHPassword != "" {
+		return append([]string{"sshpass", "-e"}, args...), []string{"SSHPASS=" + config.SSHPassword}
+	}
+	return args, nil
+}
+
+func showSSHStatus() {
+	printHeader("🔒 SSH STATUS")
+	printTerminalStatus("SSH Terminal", "ssh", config.SSHPort, config.TunnelURLs.SSH)
+	for _, t := range config.Terminals {
+		printTerminalStatus("Terminal "+t.Name, t.pidName(), t.Port, t.TunnelURL)
+		if isRunning(t.pidName()) {
+			fmt.Printf("    └─ %s%s%s\n", Dim, t.Dir, Reset)
+		}
+	}
+	fmt.Println()
+}
+
+func printTerminalStatus(label, pidName string, port int, url string) {
+	if isRunning(pidName) {
+		fmt.Printf("  %s●%s %s %s[Running]%s port %s%d%s\n", BrightGreen, Reset, label, BrightGreen, Reset, BrightCyan, port, Reset)
+		fmt.Printf("    └─ http://localhost:%d\n", port)
+		if url != "" {
+			fmt.Printf("    └─ %s%s%s\n", BrightMagenta, url, Reset)
+		}
+	} else {
+		fmt.Printf("  %s○%s %s %s[Stopped]%s\n", BrightRed, Reset, label, BrightRed, Reset)
+	}
+}
+
+// ==================== Built-in terminal ====================
+
+// The built-in terminal is CloudLab re-running itself as a small web
+// server: a page with xterm.js, and a WebSocket that carries keystrokes in
+// and shell output out. It's the fallback where ttyd and gotty can't be
+// installed, so it only uses the standard library.
+
+const (
+	webTerminalCmd     = "__webterm"
+	webTerminalCredEnv = "CLOUDLAB_WEBTERM_CREDENTIAL"
+)
+
+func builtinTerminalPath() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return exe
+}
+
+// runWebTerminal serves the terminal until killed:
+// __webterm --port N --bind ADDR -- shell args...
+func runWebTerminal(args []string) {
+	shell := args
+	for i, a := range args {
+		if a == "--" {
+			args, shell = args[:i], args[i+1:]
+			break
+		}
+	}
+	if len(shell) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cloudlab "+webTerminalCmd+" --port N [--bind ADDR] -- shell [args]")
+		os.Exit(2)
+	}
+	credential := os.Getenv(webTerminalCredEnv)
+	os.Unsetenv(webTerminalCredEnv)
+	bind := flagValue(args, "--bind")
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	addr := net.JoinHostPort(bind, flagValue(args, "--port"))
+
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if credential == "" {
+			return true
+		}
+		user, pass, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(credential)) == 1 {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="CloudLab Terminal"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, webTerminalPage)
+		}
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			serveTerminalSession(w, r, shell)
+		}
+	})
+	fmt.Printf("CloudLab web terminal listening on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// serveTerminalSession upgrades to a WebSocket and starts one shell for it.
+// Client messages are text: "0<input>" or "1<cols>,<rows>".
+func serveTerminalSession(w http.ResponseWriter, r *http.Request, shell []string) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+	}
+	ws, err := acceptWebSocket(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+
+	cmd := exec.Command(shell[0], shell[1:]...)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	var stdin io.Writer
+	var stdout io.Reader
+	resize := func(cols, rows int) {}
+	pipes := false
+	if pty, rs, err := startPTY(cmd); err == nil {
+		defer pty.Close()
+		stdin, stdout, resize = pty, pty, rs
+	} else {
+		// No PTY: plain pipes, with CloudLab echoing input and fixing line ends.
+		pipes = true
+		cmd = exec.Command(shell[0], shell[1:]...)
+		cmd.Env = append(os.Environ(), "TERM=dumb")
+		in, _ := cmd.StdinPipe()
+		pr, pw := io.Pipe()
+		cmd.Stdout, cmd.Stderr = pw, pw
+		if err := cmd.Start(); err != nil {
+			ws.WriteMessage(wsBinary, []byte("Failed to start shell: "+err.Error()+"\r\n"))
+			return
+		}
+		go func() {
+			cmd.Wait()
+			pw.Close()
+		}()
+		stdin, stdout = in, pr
+	}
+	defer cmd.Process.Kill()
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				out := buf[:n]
+				if pipes {
+					out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+				}
+				if ws.WriteMessage(wsBinary, out) != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		ws.Close()
+	}()
+
+	for {
+		msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case '0':
+			in := msg[1:]
+			if pipes {
+				in = bytes.ReplaceAll(in, []byte("\r"), []byte("\n"))
+				ws.WriteMessage(wsBinary, bytes.ReplaceAll(in, []byte("\n"), []byte("\r\n")))
+			}
+			stdin.Write(in)
+		case '1':
+			var cols, rows int
+			if _, err := fmt.Sscanf(string(msg[1:]), "%d,%d", &cols, &rows); err == nil && cols > 0 && rows > 0 {
+				resize(cols, rows)
+			}
+		}
+	}
+}
+
+const (
+	wsText   = 1
+	wsBinary = 2
+	wsClose  = 8
+	wsPing   = 9
+	wsPong   = 10
+)
+
+// wsConn is just enough of RFC 6455 for one browser talking to this server.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		return nil, errors.New("expected a WebSocket upgrade")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be upgraded")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// joining fragments on the way.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return nil, err
+		}
+		fin, op := head[0]&0x80 != 0, head[0]&0x0f
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(ext[0])<<8 | uint64(ext[1])
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return nil, err
+			}
+			n = 0
+			for _, b := range ext {
+				n = n<<8 | uint64(b)
+			}
+		}
+		if n > 1<<20 {
+			return nil, errors.New("websocket frame too large")
+		}
+		// RFC 6455 requires every client frame to be masked.
+		if head[1]&0x80 == 0 {
+			return nil, errors.New("websocket client frame not masked")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsClose:
+			c.WriteMessage(wsClose, nil)
+			return nil, io.EOF
+		case wsPing:
+			c.WriteMessage(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) WriteMessage(op byte, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	head := []byte{0x80 | op}
+	switch n := len(data); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n < 1<<16:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		head = append(head, 127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	if _, err := c.rw.Write(append(head, data...)); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// webTerminalPage uses xterm.js from a CDN and falls back to a bare text
+// view if the browser can't reach it.
+const webTerminalPage = `<!doctype html>
+<html><head><meta charset="utf-8"><title>CloudLab Terminal</title>
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/css/xterm.css">
+<script src="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/lib/xterm.js"></script>
+<script src="https://cdn.jsdelivr.net/npm/@xterm/addon-fit@0.10.0/lib/addon-fit.js"></script>
+<style>html,body{margin:0;height:100%;background:#000}#t{height:100%}
+pre{margin:0;padding:8px;color:#ddd;font:14px monospace;white-space:pre-wrap}</style>
+</head><body><div id="t"></div><script>
+const base = location.pathname.replace(/[^/]*$/, '');
+const ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + base + 'ws');
+ws.binaryType = 'arraybuffer';
+const send = s => ws.readyState === 1 && ws.send('0' + s);
+if (window.Terminal && window.FitAddon) {
+  const term = new Terminal({cursorBlink: true});
+  const fit = new FitAddon.FitAddon();
+  term.loadAddon(fit);
+  term.open(document.getElementById('t'));
+  const resize = () => { fit.fit(); ws.readyState === 1 && ws.send('1' + term.cols + ',' + term.rows); };
+  window.onresize = resize;
+  ws.onopen = () => { resize(); term.focus(); };
+  term.onData(send);
+  ws.onmessage = e => term.write(new Uint8Array(e.data));
+  ws.onclose = () => term.write('\r\n[session closed]\r\n');
+} else {
+  const out = document.createElement('pre');
+  document.getElementById('t').replaceWith(out);
+  const dec = new TextDecoder();
+  ws.onmessage = e => {
+    out.textContent += dec.decode(e.data).replace(/\x1b\[[0-9;?]*[A-Za-z]/g, '').replace(/\r/g, '');
+    window.scrollTo(0, document.body.scrollHeight);
+  };
+  ws.onclose = () => { out.textContent += '\n[session closed]\n'; };
+  const keys = {Enter: '\r', Backspace: '\x7f', Tab: '\t', Escape: '\x1b'};
+  document.onkeydown = e => {
+    let s = keys[e.key];
+    if (e.ctrlKey && e.key.length === 1) s = String.fromCharCode(e.key.toUpperCase().charCodeAt(0) - 64);
+    else if (!s && e.key.length === 1) s = e.key;
+    if (s) { send(s); e.preventDefault(); }
+  };
+}
+</script></body></html>
+`
+
+// ==================== Dashboard ====================
+
+func handleDashboard(action string) {
+	switch action {
+	case "start":
+		startDashboard()
+	case "stop":
+		stopPID("dashboard")
+		printSuccess("Dashboard stopped")
+	case "status":
+		showDashboardStatus()
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+action)
+	}
+}
+
+func showDashboardStatus() {
+	printHeader("📊 DASHBOARD STATUS")
+	if isRunning("dashboard") {
+		fmt.Printf("  %s●%s Dashboard %s[Running]%s port %s%d%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.DashboardPort, Reset)
+		fmt.Printf("    └─ http://localhost:%d\n", config.DashboardPort)
+		if config.TunnelURLs.Dashboard != "" {
+			fmt.Printf("    └─ %s%s%s\n", BrightMagenta, config.TunnelURLs.Dashboard, Reset)
+		}
+	} else {
+		fmt.Printf("  %s○%s Dashboard %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+	}
+	fmt.Println()
+}
+
+// ==================== Idle ====================
+
+func handleIdle(action string) {
+	switch action {
+	case "start":
+		startIdleMonitor()
+	case "stop":
+		stopPID("idle")
+		printSuccess("Idle monitor stopped")
+	case "status":
+		showIdleStatus()
+	case "run":
+		runIdleMonitor()
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+action)
+	}
+}
+
+func startIdleMonitor() {
+	printStep("Starting idle monitor...")
+	if config.IdleTimeout <= 0 {
+		printError("idle_timeout not set. Run: cloudlab config set idle_timeout <minutes>")
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+
+	stopPID("idle")
+
+	cmd := exec.Command(self, "idle", "run")
+	logFile, _ := os.OpenFile(filepath.Join(cloudlabDir, "logs", "idle.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	savePID("idle", cmd.Process.Pid)
+	fmt.Printf("  %s✓%s Idle monitor running (timeout %s%d min%s)\n", BrightGreen, Reset, BrightCyan, config.IdleTimeout, Reset)
+}
+
+func showIdleStatus() {
+	printHeader("💤 IDLE MONITOR")
+	if isRunning("idle") {
+		fmt.Printf("  %s●%s Idle monitor %s[Running]%s timeout %s%d min%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.IdleTimeout, Reset)
+	} else {
+		fmt.Printf("  %s○%s Idle monitor %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+	}
+	if config.IdleTimeout <= 0 {
+		printInfo("Disabled. Run: cloudlab config set idle_timeout <minutes>")
+	}
+	fmt.Println()
+}
+
+func runIdleMonitor() {
+	firstSeen := map[string]time.Time{}
+	logf := func(format string, a ...interface{}) {
+		fmt.Printf("%s %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, a...))
+	}
+	logf("idle monitor started (timeout %d min)", config.IdleTimeout)
+
+	for {
+		loadConfig()
+		if config.IdleTimeout <= 0 {
+			logf("idle_timeout disabled, exiting")
+			return
+		}
+		timeout := time.Duration(config.IdleTimeout) * time.Minute
+
+		checks := []struct {
+			name  string
+			label string
+			last  func() (time.Time, error)
+		}{
+			{"jupyter", "Jupyter", jupyterLastActivity},
+			{"vscode", "VS Code", vscodeLastActivity},
+		}
+		for _, c := range checks {
+			if !isRunning(c.name) {
+				delete(firstSeen, c.name)
+				continue
+			}
+			if _, ok := firstSeen[c.name]; !ok {
+				firstSeen[c.name] = time.Now()
+			}
+			last, err := c.last()
+			if err != nil {
+				logf("%s: activity check failed: %v", c.name, err)
+				continue
+			}
+			if last.Before(firstSeen[c.name]) {
+				last = firstSeen[c.name]
+			}
+			if idle := time.Since(last); idle >= timeout {
+				logf("%s idle for %s, stopping", c.name, idle.Round(time.Minute))
+				stopPID("tunnel_" + c.name)
+				stopPID(c.name)
+				delete(firstSeen, c.name)
+				if config.IdleNotify && emailReady() {
+					body := fmt.Sprintf(`<html><body style="font-family:sans-serif;padding:40px;background:#f5f5f5;">
+<div style="max-width:500px;margin:0 auto;background:white;padding:40px;border-radius:16px;">
+<h1 style="color:#7c3aed;">☁️ CloudLab</h1>
+<p>%s was stopped after %d minutes without activity.</p>
+<p>Run <code>cloudlab start %s</code> to bring it back.</p>
+</div></body></html>`, c.label, config.IdleTimeout, c.name)
+					if err := sendEmail("CloudLab - "+c.label+" stopped (idle) - "+instanceName(), body); err != nil {
+						logf("email failed: %v", err)
+					}
+				}
+			}
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+func jupyterLastActivity() (time.Time, error) {
+	base := jupyterLocalURL()
+	client, err := jupyterClient(base)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := client.Get(base + "/api/status")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("/api/status returned %s", resp.Status)
+	}
+	var status struct {
+		LastActivity string `json:"last_activity"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, status.LastActivity)
+}
+
+// jupyterAccess prints ready-to-share Jupyter URLs, with ?token= when the
+// running server has one. CloudLab configures password login, so usually
+// that's what it points to instead.
+func jupyterAccess() {
+	printHeader("🔑 JUPYTER ACCESS")
+	if !isRunning("jupyter") {
+		printError("Jupyter is not running. Run: cloudlab start jupyter")
+		return
+	}
+	path := "/lab"
+	if jupyterMode() == "notebook" {
+		path = "/tree"
+	}
+	token := runningJupyterToken()
+	query := ""
+	if token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+	if config.JupyterSocket != "" {
+		fmt.Printf("  %-8s : %s%s%s\n", "Socket", BrightBlue, config.JupyterSocket, Reset)
+	} else {
+		fmt.Printf("  %-8s : %s%s%s%s\n", "Local", BrightCyan, "http://"+localAddr(config.JupyterPort)+path, query, Reset)
+	}
+	if config.TunnelURLs.Jupyter != "" && isRunning("tunnel_jupyter") {
+		fmt.Printf("  %-8s : %s%s%s%s\n", "Tunnel", BrightMagenta, config.TunnelURLs.Jupyter+path, query, Reset)
+	}
+	switch {
+	case token != "":
+	case config.JupyterPassword != "":
+		printInfo("Token access is off; log in with the password: " + config.JupyterPassword)
+	default:
+		printWarning("Neither a token nor a password is set: anyone with the URL gets in")
+	}
+}
+
+// runningJupyterToken asks `jupyter server list` for the token of the
+// server CloudLab started, matching it by pid.
+func runningJupyterToken() string {
+	out, err := exec.Command(getJupyterPath(), "server", "list", "--json").Output()
+	if err != nil {
+		return ""
+	}
+	pid := getPID("jupyter")
+	for _, line := range strings.Split(string(out), "\n") {
+		var srv struct {
+			PID   int    `json:"pid"`
+			Port  int    `json:"port"`
+			Token string `json:"token"`
+		}
+		if json.Unmarshal([]byte(line), &srv) == nil && (srv.PID == pid || srv.Port == config.JupyterPort) {
+			return srv.Token
+		}
+	}
+	return ""
+}
+
+func vscodeLastActivity() (time.Time, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + localAddr(config.VSCodePort) + "/healthz")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	var health struct {
+		LastHeartbeat int64 `json:"lastHeartbeat"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(health.LastHeartbeat), nil
+}
+
+// jupyterLocalURL is the base URL for talking to Jupyter directly. With
+// jupyter_socket set the host is a placeholder and jupyterClient dials the
+// socket instead.
+func jupyterLocalURL() string {
+	if config.JupyterSocket != "" {
+		return "http://jupyter.sock"
+	}
+	return "http://" + localAddr(config.JupyterPort)
+}
+
+func jupyterClient(base string) (*http.Client, error) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 10 * time.Second}
+	if config.JupyterSocket != "" && base == jupyterLocalURL() {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", config.JupyterSocket)
+			},
+		}
+	}
+	if config.JupyterPassword == "" {
+		return client, nil
+	}
+
+	resp, err := client.Get(base + "/login")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	u, _ := url.Parse(base)
+	xsrf := ""
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "_xsrf" {
+			xsrf = c.Value
+		}
+	}
+	resp, err = client.PostForm(base+"/login", url.Values{"password": {config.JupyterPassword}, "_xsrf": {xsrf}})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("jupyter login failed: %s", resp.Status)
+	}
+	return client, nil
+}
+
+// ==================== Selftest ====================
+
+// selftest creates a throwaway kernel, serves it from a private Jupyter on a
+// free port, checks the API answers with the configured password and then
+// removes everything again. It returns the process exit code.
+func selftest() int {
+	printHeader("🧪 SELFTEST")
+	jp := getJupyterPath()
+	if _, err := os.Stat(jp); err != nil {
+		printErrorCode(codeNotInstalled, "Jupyter not found. Run: cloudlab install jupyter")
+		return 1
+	}
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found. Run: cloudlab install uv")
+		return 1
+	}
+
+	name := "cloudlab-selftest-" + genToken(6)
+	env := filepath.Join(cloudlabDir, "envs", name)
+	defer func() {
+		printStep("Cleaning up...")
+		command(jp, "kernelspec", "uninstall", name, "-f").Run()
+		os.RemoveAll(env)
+	}()
+
+	python, err := pythonFor("")
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return 1
+	}
+	printStep("Creating environment " + name + "...")
+	if err := runCmd("uv venv", command(uv, "venv", env, "--python", python)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return 1
+	}
+	py := envPython(env)
+	if err := runCmd("pip install ipykernel", command(uv, "pip", "install", "ipykernel", "--python", py)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return 1
+	}
+	printSuccess("Environment created")
+
+	printStep("Registering kernel...")
+	if err := runCmd("ipykernel install", command(py, "-m", "ipykernel", "install", "--user", "--name", name)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return 1
+	}
+	printSuccess("Kernel registered")
+
+	printStep("Starting Jupyter on a free port...")
+	port, err := freePort()
+	if err != nil {
+		printErrorCode(errCode(err), "No free port: "+err.Error())
+		return 1
+	}
+	logPath := filepath.Join(cloudlabDir, "logs", "selftest.log")
+	logFile, _ := os.Create(logPath)
+	defer logFile.Close()
+	// --ServerApp.sock='' overrides jupyter_socket from the config file, so
+	// this instance listens on the TCP port probed below.
+	cmd := exec.Command(jp, "lab", "--no-browser", "--ip=127.0.0.1", fmt.Sprintf("--port=%d", port), "--ServerApp.sock=''",
+		fmt.Sprintf("--notebook-dir=%s", config.WorkDir), "--ServerApp.token=''")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return 1
+	}
+	defer cmd.Process.Kill()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	if !waitReady("Jupyter", cmd, "tcp", addr, logPath) {
+		return 1
+	}
+	printSuccess(fmt.Sprintf("Jupyter listening on port %d", port))
+
+	printStep("Checking the Jupyter API...")
+	base := "http://" + addr
+	client, err := jupyterClient(base)
+	if err != nil {
+		printErrorCode(errCode(err), "Login failed: "+err.Error())
+		return 1
+	}
+	resp, err := client.Get(base + "/api/kernelspecs")
+	if err != nil {
+		printErrorCode(errCode(err), "Request failed: "+err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		printError("/api/kernelspecs returned " + resp.Status)
+		return 1
+	}
+	var specs struct {
+		Kernelspecs map[string]json.RawMessage `json:"kernelspecs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&specs); err != nil {
+		printErrorCode(errCode(err), "Unexpected response: "+err.Error())
+		return 1
+	}
+	if _, ok := specs.Kernelspecs[name]; !ok {
+		printError("Kernel " + name + " is not visible to Jupyter")
+		return 1
+	}
+	printSuccess("API answered 200 and lists the new kernel")
+
+	printSuccess("Selftest passed")
+	return 0
+}
+
+// ==================== Fetch ====================
+
+func fetchFile(remote, local string, viaTunnel bool) {
+	base := jupyterLocalURL()
+	if viaTunnel {
+		if config.TunnelURLs.Jupyter == "" {
+			printError("No Jupyter tunnel URL. Run: cloudlab tunnel start")
+			return
+		}
+		base = strings.TrimRight(config.TunnelURLs.Jupyter, "/")
+	} else if !isRunning("jupyter") {
+		printError("Jupyter is not running. Run: cloudlab start jupyter")
+		return
+	}
+	printStep(fmt.Sprintf("Fetching %s from %s...", remote, base))
+
+	client, err := jupyterClient(base)
+	if err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	client.Timeout = 10 * time.Minute
+
+	segments := strings.Split(strings.Trim(filepath.ToSlash(remote), "/"), "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	resp, err := client.Get(base + "/api/contents/" + strings.Join(segments, "/") + "?type=file&format=base64&content=1")
+	if err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		printError(fmt.Sprintf("Failed: %s returned %s", remote, resp.Status))
+		return
+	}
+
+	var file struct {
+		Content string `json:"content"`
+		Format  string `json:"format"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	data := []byte(file.Content)
+	if file.Format == "base64" {
+		if data, err = base64.StdEncoding.DecodeString(file.Content); err != nil {
+			printErrorCode(errCode(err), "Failed: "+err.Error())
+			return
+		}
+	}
+	if err := os.WriteFile(local, data, 0644); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	printSuccess(fmt.Sprintf("Saved %s (%d bytes)", local, len(data)))
+}
+
+// ==================== Serve dir ====================
+
+// serveDir shares a directory read-only through a quick tunnel until
+// Ctrl+C. Dotfiles (.git, .env, ...) are not served.
+func serveDir(path, portFlag string, email bool) {
+	dir := expandPath(path)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		printErrorCode(codeNotFound, "Directory not found: "+dir)
+		return
+	}
+	cf, err := exec.LookPath("cloudflared")
+	if err != nil {
+		printErrorCode(codeNotInstalled, "cloudflared not found. Run: cloudlab install cloudflare")
+		return
+	}
+	port, err := strconv.Atoi(portFlag)
+	if portFlag == "" {
+		port, err = freePort()
+	}
+	if err != nil || port < 1 || port > 65535 {
+		printErrorCode(codeInvalid, "Invalid port: "+portFlag)
+		return
+	}
+	// Catch Ctrl+C from here on, so the tunnel below is always stopped.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	// os.Root refuses symlinks that lead out of dir.
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	defer root.Close()
+	l, err := net.Listen("tcp", localAddr(port))
+	if err != nil {
+		printErrorCode(codePortInUse, fmt.Sprintf("Port %d is not available: %v", port, err))
+		return
+	}
+	files := http.FileServer(http.FS(root.FS()))
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		if _, err := root.Stat("." + r.URL.Path); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer l.Close()
+
+	printHeader("📂 SERVE DIRECTORY")
+	printInfo(fmt.Sprintf("Serving %s on http://%s", dir, localAddr(port)))
+	printStep("Starting tunnel...")
+	url := startTunnel(cf, "serve", port)
+	defer stopPID("tunnel_serve")
+	if url == "" {
+		return
+	}
+	printSuccess("Public URL: " + BrightCyan + url + Reset)
+	printWarning("Anyone with this URL can read the files in " + dir)
+	if email {
+		if !emailReady() {
+			printWarning("Email not configured. Run: cloudlab email setup")
+		} else if err := sendEmail("CloudLab - Sharing "+filepath.Base(dir)+" - "+instanceName(), fmt.Sprintf(`<html><body style="font-family:sans-serif;">
+<p><strong>%s</strong> is shared at <a href="%s">%s</a> until it is stopped.</p>
+</body></html>`, dir, url, url)); err != nil {
+			printErrorCode(errCode(err), "Failed to send email: "+err.Error())
+		} else {
+			printSuccess("URL sent to " + config.Email)
+		}
+	}
+	fmt.Printf("\n  %sPress Ctrl+C to stop sharing%s\n", Dim, Reset)
+	<-sigs
+	fmt.Println()
+	printSuccess("Stopped sharing " + dir)
+}
+
+// ==================== Status ====================
+
+func showStatus() {
+	fmt.Println(getLogo())
+	printHeader("📊 SERVICE STATUS")
+
+	for _, svc := range services() {
+		label := svc.Label
+		if isRunning(svc.Name) {
+			if svc.Detail != "" {
+				label += " " + svc.Detail
+			}
+			where, addr, _ := strings.Cut(svc.Where(), " ")
+			fmt.Printf("  %s●%s %s %s[Running]%s %s %s%s%s\n", BrightGreen, Reset, label, BrightGreen, Reset, where, BrightCyan, addr, Reset)
+		} else if !svc.Enabled() {
+			fmt.Printf("  %s-%s %s %s[Disabled]%s\n", Dim, Reset, label, Dim, Reset)
+		} else {
+			fmt.Printf("  %s○%s %s %s[Stopped]%s\n", BrightRed, Reset, label, BrightRed, Reset)
+		}
+	}
+
+	showTunnelStatus()
+
+	printHeader("🔐 CREDENTIALS")
+	fmt.Printf("  Jupyter:   %s%s%s\n", BrightYellow, config.JupyterPassword, Reset)
+	fmt.Printf("  VS Code:   %s%s%s\n", BrightYellow, config.VSCodePassword, Reset)
+	fmt.Printf("  SSH User:  %s%s%s\n", BrightYellow, config.SSHUser, Reset)
+	if config.SSHPassword != "" {
+		fmt.Printf("  SSH Pass:  %s%s%s\n", BrightYellow, config.SSHPassword, Reset)
+	}
+	fmt.Println()
+}
+
+// serviceState is what `status <service>` reports, and its --output json data.
+type serviceState struct {
+	Name          string `json:"name"`
+	Running       bool   `json:"running"`
+	Enabled       bool   `json:"enabled"`
+	PID           int    `json:"pid,omitempty"`
+	Port          int    `json:"port,omitempty"`
+	Socket        string `json:"socket,omitempty"`
+	TunnelURL     string `json:"tunnel_url,omitempty"`
+	TunnelRunning bool   `json:"tunnel_running"`
+}
+
+// serviceStatus prints one service's state and returns the exit code:
+// 0 when it's running, 3 (LSB "not running") when it isn't.
+func serviceStatus(name string) int {
+	target, ok := tunnelTarget(name)
+	if !ok {
+		printErrorCode(codeNotFound, "Unknown service: "+name)
+		return 2
+	}
+	st := serviceState{Name: target, Running: isRunning(target), Enabled: true, TunnelRunning: isRunning("tunnel_" + target)}
+	label := target
+	if svc := findService(target); svc != nil {
+		label, st.Enabled, st.Port, st.TunnelURL = svc.Label, svc.Enabled(), svc.Port(), *svc.URL()
+		if svc.Socket != nil {
+			st.Socket = svc.Socket()
+		}
+	} else if t := findTerminal(target); t != nil {
+		label, st.Port, st.TunnelURL = "Terminal "+t.Name, t.Port, t.TunnelURL
+	}
+	if st.Running {
+		st.PID = getPID(target)
+	}
+	setJSONData(st)
+
+	switch {
+	case st.Running:
+		where := fmt.Sprintf("port %s%d%s", BrightCyan, st.Port, Reset)
+		if st.Socket != "" {
+			where = "socket " + BrightCyan + st.Socket + Reset
+		}
+		fmt.Printf("  %s●%s %s %s[Running]%s pid %d, %s\n", BrightGreen, Reset, label, BrightGreen, Reset, st.PID, where)
+	case !st.Enabled:
+		fmt.Printf("  %s-%s %s %s[Disabled]%s\n", Dim, Reset, label, Dim, Reset)
+	default:
+		fmt.Printf("  %s○%s %s %s[Stopped]%s\n", BrightRed, Reset, label, BrightRed, Reset)
+	}
+	if st.TunnelRunning && st.TunnelURL != "" {
+		fmt.Printf("    └─ %s%s%s\n", BrightMagenta, st.TunnelURL, Reset)
+	}
+	if !st.Running {
+		jsonMu.Lock()
+		jsonOut.Code = "not_running"
+		jsonMu.Unlock()
+		return 3
+	}
+	return 0
+}
+
+type healthResult struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// health checks every running service answers. By default that means the
+// port (or socket) accepts connections; with --http each must answer HTTP,
+// and Jupyter must accept the configured password and return its
+// /api/status, since its login page loads even when the server is broken.
+// It returns 1 if anything is not healthy.
+func health(httpCheck bool) int {
+	printHeader("🩺 HEALTH")
+	var results []healthResult
+	failed := 0
+	for _, svc := range services() {
+		if !isRunning(svc.Name) {
+			continue
+		}
+		r := healthResult{Name: svc.Name}
+		switch {
+		case httpCheck && svc.Name == "jupyter":
+			r.State, r.Detail = jupyterHealth()
+		case httpCheck:
+			r.State, r.Detail = httpHealth(svc)
+		default:
+			r.State, r.Detail = dialHealth(svc)
+		}
+		results = append(results, r)
+
+		icon, color := "●", BrightGreen
+		if r.State != "healthy" {
+			failed++
+			icon, color = "○", BrightRed
+			if r.State == "unauthenticated" {
+				icon, color = "◐", BrightYellow
+			}
+		}
+		fmt.Printf("  %s%s%s %-10s %s%s%s", color, icon, Reset, svc.Label, color, r.State, Reset)
+		if r.Detail != "" {
+			fmt.Printf(" %s(%s)%s", Dim, r.Detail, Reset)
+		}
+		fmt.Println()
+	}
+	setJSONData(results)
+	if len(results) == 0 {
+		printInfo("No services running")
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func dialHealth(svc Service) (string, string) {
+	network, addr := "tcp", localAddr(svc.Port())
+	if svc.Socket != nil && svc.Socket() != "" {
+		network, addr = "unix", svc.Socket()
+	}
+	conn, err := net.DialTimeout(network, addr, 3*time.Second)
+	if err != nil {
+		return "unreachable", err.Error()
+	}
+	conn.Close()
+	return "healthy", "listening on " + addr
+}
+
+func httpHealth(svc Service) (string, string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + localAddr(svc.Port()) + "/")
+	if err != nil {
+		return "unreachable", err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return "unhealthy", resp.Status
+	}
+	return "healthy", resp.Status
+}
+
+// jupyterHealth tells "something answers" apart from "Jupyter accepts our
+// password and its API works".
+func jupyterHealth() (string, string) {
+	base := jupyterLocalURL()
+	client, err := jupyterClient(base)
+	if err != nil {
+		if strings.Contains(err.Error(), "login failed") {
+			return "unauthenticated", "reachable, but " + err.Error()
+		}
+		return "unreachable", err.Error()
+	}
+	resp, err := client.Get(base + "/api/status")
+	if err != nil {
+		return "unreachable", err.Error()
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+		return "unauthenticated", "reachable, but jupyter_password was not accepted"
+	case resp.StatusCode != http.StatusOK:
+		return "unhealthy", "/api/status returned " + resp.Status
+	}
+	var status struct {
+		Started     string `json:"started"`
+		Kernels     *int   `json:"kernels"`
+		Connections int    `json:"connections"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Started == "" || status.Kernels == nil {
+		return "unhealthy", "/api/status did not return Jupyter's status JSON"
+	}
+	return "healthy", fmt.Sprintf("%d kernels, %d connections", *status.Kernels, status.Connections)
+}
+
+func showInfo() {
+	fmt.Printf("%s☁️  CloudLab v%s%s\n", BrightCyan+Bold, VERSION, Reset)
+	printHeader("📋 SUMMARY")
+
+	for _, svc := range services() {
+		label := strings.TrimSpace(svc.Label + " " + svc.Detail)
+		if isRunning(svc.Name) {
+			where, addr, _ := strings.Cut(svc.Where(), " ")
+			fmt.Printf("  %s●%s %-16s %s %s%-5s%s pid %s%d%s\n", BrightGreen, Reset, label, where, BrightCyan, addr, Reset, Dim, getPID(svc.Name), Reset)
+		} else if !svc.Enabled() {
+			fmt.Printf("  %s-%s %-16s %s[Disabled]%s\n", Dim, Reset, label, Dim, Reset)
+		} else {
+			fmt.Printf("  %s○%s %-16s %s[Stopped]%s\n", BrightRed, Reset, label, BrightRed, Reset)
+		}
+		if url := *svc.URL(); url != "" {
+			fmt.Printf("    └─ %s%s%s\n", BrightMagenta, url, Reset)
+		}
+	}
+
+	gpu := "CPU"
+	if config.EnableMPS {
+		gpu = "MPS (Apple Silicon)"
+	} else if config.EnableCUDA {
+		gpu = "CUDA (NVIDIA)"
+	}
+	email := "not configured"
+	if config.Email != "" {
+		email = maskEmail(config.Email)
+		if config.SMTPPasswordCmd != "" {
+			email += " (password from command)"
+		} else if config.EmailPassword == "" {
+			email += " (no app password)"
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-18s : %s\n", "Working directory", config.WorkDir)
+	fmt.Printf("  %-18s : %s\n", "Python", config.PythonVersion)
+	fmt.Printf("  %-18s : %s\n", "GPU mode", gpu)
+	if isWSL() {
+		fmt.Printf("  %-18s : %s\n", "Platform", "WSL")
+	}
+	fmt.Printf("  %-18s : %s\n", "Email", email)
+	fmt.Printf("  %-18s : %s\n", "Jupyter password", maskSecret(config.JupyterPassword))
+	fmt.Printf("  %-18s : %s\n", "VS Code password", maskSecret(config.VSCodePassword))
+	fmt.Printf("  %-18s : %s\n", "SSH password", maskSecret(config.SSHPassword))
+	fmt.Println()
+}
+
+func watchStatus(interval time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		reconcilePIDs()
+		fmt.Print("\033[H\033[2J")
+		showStatus()
+		fmt.Printf("  %sRefreshing every %s, Ctrl+C to exit%s\n", Dim, interval, Reset)
+		select {
+		case <-sigs:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reconcilePIDs() {
+	entries, _ := os.ReadDir(filepath.Join(cloudlabDir, "pids"))
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".pid"); ok && !isRunning(name) {
+			os.Remove(filepath.Join(cloudlabDir, "pids", e.Name()))
+		}
+	}
+}
+
+func showLogs(service string, args []string) {
+	if service == "all" {
+		showAllLogs(args)
+		return
+	}
+	names := resolveService(service)
+	if len(names) > 1 && hasFlag(args, "-f", "--follow") {
+		printErrorCode(codeUsage, "--follow needs a single service, e.g. cloudlab logs "+names[0]+" -f")
+		return
+	}
+	for _, name := range names {
+		if len(names) > 1 {
+			if _, err := os.Stat(filepath.Join(cloudlabDir, "logs", name+".log")); err != nil {
+				continue
+			}
+		}
+		showLog(name, args)
+	}
+}
+
+func showLog(service string, args []string) {
+	logPath := filepath.Join(cloudlabDir, "logs", service+".log")
+	f, err := os.Open(logPath)
+	if err != nil {
+		printErrorCode(codeNotFound, "Log not found: "+logPath)
+		return
+	}
+	defer f.Close()
+
+	filter := newLogFilter(args)
+	if filter == nil {
+		return
+	}
+	tailN := logTail(args, 0)
+	follow := hasFlag(args, "-f", "--follow")
+
+	fmt.Printf("\n%s=== %s logs ===%s\n\n", BrightCyan, service, Reset)
+
+	color := logColor(args)
+	var tailed []string
+	filter.emit = func(line string) {
+		if color {
+			line = highlightLogLine(line)
+		}
+		if tailN <= 0 {
+			fmt.Println(line)
+			return
+		}
+		tailed = append(tailed, line)
+		if len(tailed) > tailN {
+			tailed = tailed[1:]
+		}
+	}
+
+	reader := bufio.NewReader(f)
+	partial := ""
+	for {
+		chunk, err := reader.ReadString('\n')
+		if err == nil {
+			filter.feed(strings.TrimRight(partial+chunk, "\r\n"))
+			partial = ""
+			continue
+		}
+		partial += chunk
+		if err != io.EOF {
+			printErrorCode(errCode(err), "Failed: "+err.Error())
+			return
+		}
+		if !follow && partial != "" {
+			filter.feed(partial)
+			partial = ""
+		}
+		for _, line := range tailed {
+			fmt.Println(line)
+		}
+		tailed, tailN = nil, 0
+		if !follow {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// newLogFilter builds a filter from --grep, -C and --since, or returns nil
+// after reporting a bad flag.
+func newLogFilter(args []string) *logFilter {
+	filter := &logFilter{}
+	if pattern := flagValue(args, "--grep"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			printErrorCode(errCode(err), "Invalid pattern: "+err.Error())
+			return nil
+		}
+		filter.re = re
+		filter.context, _ = strconv.Atoi(flagValue(args, "-C"))
+	}
+	if since := flagValue(args, "--since"); since != "" {
+		d, err := parseSince(since)
+		if err != nil {
+			printErrorCode(codeInvalid, "Invalid --since duration: "+since+" (e.g. 10m, 2h, 1d)")
+			return nil
+		}
+		filter.since = time.Now().Add(-d)
+	}
+	return filter
+}
+
+func logTail(args []string, def int) int {
+	tail := flagValue(args, "--tail")
+	if tail == "" {
+		tail = flagValue(args, "-n")
+	}
+	if n, err := strconv.Atoi(tail); err == nil {
+		return n
+	}
+	return def
+}
+
+func logColor(args []string) bool {
+	return !hasFlag(args, "--no-color") && isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+}
+
+var logSourceColors = []string{BrightCyan, BrightGreen, BrightYellow, BrightMagenta, BrightBlue}
+
+// showLogSizes lists each file in the logs directory with its size.
+func showLogSizes() {
+	printHeader("📜 LOG SIZES")
+	logDir := filepath.Join(cloudlabDir, "logs")
+	entries, _ := os.ReadDir(logDir)
+	sizes := map[string]int64{}
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		sizes[e.Name()] = info.Size()
+		total += info.Size()
+		fmt.Printf("  %-28s %s%10s%s\n", e.Name(), BrightCyan, formatBytes(uint64(info.Size())), Reset)
+	}
+	setJSONData(sizes)
+	if len(sizes) == 0 {
+		printInfo("No logs yet")
+		return
+	}
+	fmt.Printf("  %-28s %s%10s%s\n", "total", Bold, formatBytes(uint64(total)), Reset)
+	fmt.Printf("\n  %s%s%s\n", Dim, logDir, Reset)
+}
+
+// secretValues returns every password CloudLab knows about, including the
+// config.json values shadowed by CLOUDLAB_*_PASSWORD variables.
+func secretValues() []string {
+	var secrets []string
+	add := func(s string) {
+		if s == "" {
+			return
+		}
+		for _, have := range secrets {
+			if have == s {
+				return
+			}
+		}
+		secrets = append(secrets, s)
+	}
+	add(config.JupyterPassword)
+	add(config.VSCodePassword)
+	add(config.ViewerPassword)
+	add(config.SSHPassword)
+	add(config.EmailPassword)
+	for _, v := range secretOverrides {
+		add(v)
+	}
+	// Replace longer secrets first so one that contains another is still caught whole.
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	return secrets
+}
+
+func redactSecrets(data []byte, secrets []string) []byte {
+	for _, s := range secrets {
+		data = bytes.ReplaceAll(data, []byte(s), []byte("[REDACTED]"))
+	}
+	return data
+}
+
+// readLogForExport returns a log's content, optionally only the last n lines.
+func readLogForExport(name string, n int) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(cloudlabDir, "logs", name+".log"))
+	if err != nil || n <= 0 {
+		return data, err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+func exportLogs(service, dest string, tailN int) {
+	dest = expandPath(dest)
+	secrets := secretValues()
+	if service == "all" {
+		exportLogBundle(dest, tailN, secrets)
+		return
+	}
+	names := resolveService(service)
+	if len(names) > 1 {
+		printErrorCode(codeUsage, "Export needs a single log, e.g. cloudlab logs export "+names[0]+" "+dest)
+		return
+	}
+	data, err := readLogForExport(names[0], tailN)
+	if err != nil {
+		printErrorCode(codeNotFound, "Log not found: "+filepath.Join(cloudlabDir, "logs", names[0]+".log"))
+		exit(1)
+		return
+	}
+	if err := os.WriteFile(dest, redactSecrets(data, secrets), 0600); err != nil {
+		printErrorCode(errCode(err), "Could not write "+dest+": "+err.Error())
+		exit(1)
+		return
+	}
+	setJSONData(map[string]string{"service": names[0], "file": dest})
+	printSuccess("Exported " + names[0] + " log to " + dest + " (passwords redacted)")
+}
+
+// exportLogBundle writes every log plus a redacted config.json to a .tar.gz.
+func exportLogBundle(dest string, tailN int, secrets []string) {
+	if !strings.HasSuffix(dest, ".tar.gz") && !strings.HasSuffix(dest, ".tgz") {
+		printErrorCode(codeInvalid, "logs export all writes a tarball, use a .tar.gz file name")
+		exit(1)
+		return
+	}
+	redacted := config
+	for _, field := range []*string{&redacted.JupyterPassword, &redacted.VSCodePassword, &redacted.ViewerPassword, &redacted.SSHPassword, &redacted.EmailPassword, &redacted.SMTPPasswordCmd} {
+		if *field != "" {
+			*field = "[REDACTED]"
+		}
+	}
+	// A named tunnel's ID plus its credentials file is enough to run it.
+	redacted.NamedTunnels = map[string]NamedTunnel{}
+	for svc, nt := range config.NamedTunnels {
+		nt.Tunnel = "[REDACTED]"
+		redacted.NamedTunnels[svc] = nt
+	}
+	cfg, _ := json.MarshalIndent(redacted, "", "  ")
+	files := map[string][]byte{"config.json": redactSecrets(cfg, secrets)}
+	entries, _ := os.ReadDir(filepath.Join(cloudlabDir, "logs"))
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".log")
+		if e.IsDir() || !ok {
+			continue
+		}
+		if data, err := readLogForExport(name, tailN); err == nil {
+			files["logs/"+e.Name()] = redactSecrets(data, secrets)
+		}
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		printErrorCode(errCode(err), "Could not write "+dest+": "+err.Error())
+		exit(1)
+		return
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		hdr := &tar.Header{Name: "cloudlab-report/" + name, Mode: 0600, Size: int64(len(files[name])), ModTime: now}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(files[name])
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		printErrorCode(errCode(err), "Could not write "+dest+": "+err.Error())
+		exit(1)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		printErrorCode(errCode(err), "Could not write "+dest+": "+err.Error())
+		exit(1)
+		return
+	}
+	setJSONData(map[string]any{"file": dest, "files": names})
+	printSuccess(fmt.Sprintf("Exported %d logs and config to %s (passwords redacted)", len(names)-1, dest))
+}
+
+// showAllLogs interleaves the tail of every log file, each line prefixed with
+// the file it came from. Lines are merged by timestamp; a line without one
+// keeps the time of the line before it in the same file.
+func showAllLogs(args []string) {
+	logDir := filepath.Join(cloudlabDir, "logs")
+	tailN := logTail(args, 50)
+	color := logColor(args)
+
+	type source struct {
+		name   string
+		prefix string
+		offset int64
+		filter *logFilter
+	}
+	var sources []*source
+	known := map[string]bool{}
+	width := 0
+	scan := func() bool {
+		entries, _ := os.ReadDir(logDir)
+		for _, e := range entries {
+			name := strings.TrimSuffix(e.Name(), ".log")
+			if e.IsDir() || name == e.Name() || known[name] {
+				continue
+			}
+			filter := newLogFilter(args)
+			if filter == nil {
+				return false
+			}
+			known[name] = true
+			width = max(width, len(name)+2)
+			sources = append(sources, &source{name: name, filter: filter})
+		}
+		for i, src := range sources {
+			src.prefix = fmt.Sprintf("%-*s", width, "["+src.name+"]")
+			if color {
+				src.prefix = logSourceColors[i%len(logSourceColors)] + src.prefix + Reset
+			}
+		}
+		return true
+	}
+	if !scan() {
+		return
+	}
+	if len(sources) == 0 {
+		printInfo("No logs yet")
+		return
+	}
+
+	type logLine struct {
+		t    time.Time
+		src  *source
+		text string
+	}
+	var merged []logLine
+	for _, src := range sources {
+		data, err := os.ReadFile(filepath.Join(logDir, src.name+".log"))
+		if err != nil {
+			continue
+		}
+		src.offset = int64(len(data))
+		var last time.Time
+		var lines []logLine
+		src.filter.emit = func(line string) {
+			if t, ok := parseLogTime(line); ok {
+				last = t
+			}
+			lines = append(lines, logLine{last, src, line})
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			src.filter.feed(strings.TrimRight(line, "\r"))
+		}
+		if tailN > 0 && len(lines) > tailN {
+			lines = lines[len(lines)-tailN:]
+		}
+		merged = append(merged, lines...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].t.Before(merged[j].t) })
+	for _, l := range merged {
+		if color {
+			l.text = highlightLogLine(l.text)
+		}
+		fmt.Println(l.src.prefix + " " + l.text)
+	}
+
+	if !hasFlag(args, "-f", "--follow") {
+		return
+	}
+	for _, src := range sources {
+		src.filter.emit = nil
+	}
+	for {
+		time.Sleep(500 * time.Millisecond)
+		scan()
+		for _, src := range sources {
+			f, err := os.Open(filepath.Join(logDir, src.name+".log"))
+			if err != nil {
+				continue
+			}
+			if info, err := f.Stat(); err == nil && info.Size() < src.offset {
+				src.offset = 0 // truncated or rotated
+			}
+			f.Seek(src.offset, io.SeekStart)
+			data, _ := io.ReadAll(f)
+			f.Close()
+			end := bytes.LastIndexByte(data, '\n')
+			if end < 0 {
+				continue
+			}
+			src.offset += int64(end + 1)
+			prefix := src.prefix
+			src.filter.emit = func(line string) {
+				if color {
+					line = highlightLogLine(line)
+				}
+				fmt.Println(prefix + " " + line)
+			}
+			for _, line := range strings.Split(string(data[:end]), "\n") {
+				src.filter.feed(strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+}
+
+var (
+	logErrorRe = regexp.MustCompile(`\b(ERROR|CRITICAL|FATAL|Traceback)\b|\[(E|C) `)
+	logWarnRe  = regexp.MustCompile(`\b(WARNING|WARN)\b|\[W `)
+	logURLRe   = regexp.MustCompile(`https?://[^\s'"<>]+`)
+)
+
+func highlightLogLine(line string) string {
+	switch {
+	case logErrorRe.MatchString(line):
+		return BrightRed + line + Reset
+	case logWarnRe.MatchString(line):
+		return BrightYellow + line + Reset
+	}
+	return logURLRe.ReplaceAllString(line, Underline+BrightCyan+"$0"+Reset)
+}
+
+var (
+	logTimestampRe = regexp.MustCompile(`(\d{4}-\d{2}-\d{2})[T ](\d{2}:\d{2}:\d{2})(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+	logClockRe     = regexp.MustCompile(`^\[[A-Z] (\d{2}:\d{2}:\d{2})`)
+)
+
+// parseLogTime reads the timestamp near the start of a Jupyter, code-server,
+// cloudflared or CloudLab log line.
+func parseLogTime(line string) (time.Time, bool) {
+	head := line
+	if len(head) > 48 {
+		head = head[:48]
+	}
+	if m := logTimestampRe.FindStringSubmatch(head); m != nil {
+		stamp := m[1] + "T" + m[2] + m[3]
+		if zone := m[4]; zone != "" {
+			if len(zone) == 5 {
+				zone = zone[:3] + ":" + zone[3:]
+			}
+			t, err := time.Parse(time.RFC3339Nano, stamp+zone)
+			return t, err == nil
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04:05.999999999", stamp, time.Local)
+		return t, err == nil
+	}
+	if m := logClockRe.FindStringSubmatch(head); m != nil {
+		clock, err := time.ParseInLocation("15:04:05", m[1], time.Local)
+		if err != nil {
+			return time.Time{}, false
+		}
+		now := time.Now()
+		return time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.Local), true
+	}
+	return time.Time{}, false
+}
+
+func parseSince(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		return time.Duration(days) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// logFilter passes log lines through an optional regexp, keeping up to
+// context lines around each match like grep -C.
+type logFilter struct {
+	re      *regexp.Regexp
+	context int
+	since   time.Time
+	emit    func(string)
+
+	inWindow bool
+	before   []string
+	after    int
+	lineNo   int
+	lastOut  int
+}
+
+func (f *logFilter) feed(line string) {
+	if !f.since.IsZero() {
+		if t, ok := parseLogTime(line); ok {
+			f.inWindow = !t.Before(f.since)
+		}
+		if !f.inWindow {
+			return
+		}
+	}
+	f.lineNo++
+	if f.re == nil {
+		f.emit(line)
+		return
+	}
+	if f.re.MatchString(line) {
+		if f.context > 0 && f.lastOut > 0 && f.lineNo-len(f.before) > f.lastOut+1 {
+			f.emit("--")
+		}
+		for _, b := range f.before {
+			f.emit(b)
+		}
+		f.before = f.before[:0]
+		f.emit(line)
+		f.lastOut, f.after = f.lineNo, f.context
+		return
+	}
+	if f.after > 0 {
+		f.emit(line)
+		f.lastOut = f.lineNo
+		f.after--
+		return
+	}
+	if f.context > 0 {
+		f.before = append(f.before, line)
+		if len(f.before) > f.context {
+			f.before = f.before[1:]
+		}
+	}
+}
+
+// ==================== Audit ====================
+
+// exposure is one listener as `cloudlab audit` sees it. auth is empty when
+// anyone who can connect gets in; tunnel is the live URL, "on start", or "".
+type exposure struct {
+	label, where, auth, tunnel string
+	risk, why                  string
+}
+
+func audit() int {
+	printHeader("🛡️  EXPOSURE AUDIT")
+	high, warn := 0, 0
+	for _, e := range auditExposures() {
+		marker := BrightGreen + "✓"
+		switch e.risk {
+		case "high":
+			marker = BrightRed + "✗"
+			high++
+		case "warn":
+			marker = BrightYellow + "!"
+			warn++
+		}
+		fmt.Printf("  %s%s %-14s %-22s auth: %-10s tunnel: %s\n", marker, Reset, e.label, e.where, orNone(e.auth), orNone(e.tunnel))
+		if e.why != "" {
+			fmt.Printf("    └─ %s\n", e.why)
+		}
+	}
+	fmt.Println()
+	switch {
+	case high > 0:
+		printError(fmt.Sprintf("%d high-risk exposure(s): set passwords or stop the tunnels before going live", high))
+		return 1
+	case warn > 0:
+		printWarning(fmt.Sprintf("%d warning(s), no high-risk exposures", warn))
+	default:
+		printSuccess("No risky exposures found")
+	}
+	return 0
+}
+
+func auditExposures() []exposure {
+	ip := net.ParseIP(bindAddress())
+	onNetwork := ip == nil || !ip.IsLoopback()
+	tunnelState := func(name, url string, planned bool) string {
+		switch {
+		case isRunning("tunnel_"+name) && url != "":
+			return url
+		case isRunning("tunnel_" + name):
+			return "live"
+		case planned:
+			return "on start"
+		}
+		return ""
+	}
+	terminalAuth := ""
+	switch {
+	case config.SSHPassword != "":
+		terminalAuth = "password"
+	case !isLocalHost(config.SSHHost):
+		terminalAuth = "ssh login"
+	}
+
+	var out []exposure
+	assess := func(e exposure, password, noAuthWhy string) {
+		public := "a public tunnel points at it"
+		if e.tunnel == "on start" {
+			public = "a public tunnel opens with it on start"
+		}
+		switch {
+		case e.auth == "" && e.tunnel != "":
+			e.risk, e.why = "high", noAuthWhy+", and "+public
+		case e.auth == "" && onNetwork && !strings.HasPrefix(e.where, "unix:"):
+			e.risk, e.why = "warn", noAuthWhy+"; anyone on the network can reach it (bind_address "+bindAddress()+")"
+		case e.auth == "password" && e.tunnel != "" && weakPassword(password) != "":
+			e.risk, e.why = "warn", "weak password behind a public tunnel: "+weakPassword(password)
+		}
+		out = append(out, e)
+	}
+
+	for _, svc := range services() {
+		running := isRunning(svc.Name)
+		e := exposure{label: svc.Label, where: net.JoinHostPort(bindAddress(), strconv.Itoa(svc.Port()))}
+		if svc.Socket != nil && svc.Socket() != "" {
+			e.where = "unix:" + svc.Socket()
+		}
+		if !running && !svc.Enabled() {
+			e.where = "disabled"
+			out = append(out, e)
+			continue
+		}
+		e.tunnel = tunnelState(svc.Name, *svc.URL(), config.TunnelEnabled)
+		switch svc.Name {
+		case "jupyter":
+			if config.JupyterPassword != "" {
+				e.auth = "password"
+			}
+			assess(e, config.JupyterPassword, "Jupyter runs with token='' and no password")
+		case "vscode":
+			if config.VSCodePassword != "" {
+				e.auth = "password"
+			}
+			assess(e, config.VSCodePassword, "code-server has no password and includes a terminal")
+		case "ssh":
+			e.auth = terminalAuth
+			assess(e, config.SSHPassword, "writable shell with no password")
+		case "dashboard":
+			assess(e, "", "the dashboard has no login and its API runs cloudlab commands")
+		case "viewer":
+			e.auth = "password"
+			assess(e, config.ViewerPassword, "")
+		}
+	}
+	for _, t := range config.Terminals {
+		e := exposure{label: t.Name, where: net.JoinHostPort(bindAddress(), strconv.Itoa(t.Port)), auth: terminalAuth}
+		e.tunnel = tunnelState(t.pidName(), t.TunnelURL, t.Tunnel)
+		assess(e, config.SSHPassword, "writable shell with no password")
+	}
+	return out
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// ==================== Kernels ====================
+
+func handleKernel(args []string) {
+	switch args[0] {
+	case "list":
+		listKernels()
+	case "add":
+		names := positional(args[1:], "--display-name", "--dir")
+		if len(names) < 1 {
+			printErrorCode(codeUsage, "Usage: cloudlab kernel add <name> [version] [--display-name <name>] [--dir <path>] [--system-site-packages] [--gpu|--no-gpu] [--offline]")
+			return
+		}
+		if dir := flagValue(args, "--dir"); dir != "" && !setEnvDir(names[0], dir) {
+			return
+		}
+		ver := ""
+		if len(names) > 1 {
+			ver = names[1]
+		}
+		forceFlag = hasFlag(args, "--force")
+		if offlineFlag = hasFlag(args, "--offline"); offlineFlag && !checkOfflineDir() {
+			return
+		}
+		torch := "auto"
+		if hasFlag(args, "--no-gpu", "--cpu") {
+			torch = "no"
+		} else if hasFlag(args, "--gpu") {
+			torch = "yes"
+		}
+		addKernel(names[0], ver, flagValue(args, "--display-name"), hasFlag(args, "--system-site-packages"), torch)
+		if hasFlag(args, "--dir") {
+			saveEnvDir(names[0])
+		}
+	case "remove", "rm":
+		if len(args) < 2 {
+			printErrorCode(codeUsage, "Usage: cloudlab kernel remove <name>")
+			return
+		}
+		removeKernel(args[1])
+	case "info":
+		if len(args) < 2 {
+			printErrorCode(codeUsage, "Usage: cloudlab kernel info <name>")
+			return
+		}
+		showKernelInfo(args[1])
+	case "export":
+		if len(args) < 3 {
+			printErrorCode(codeUsage, "Usage: cloudlab kernel export <name> <file>")
+			return
+		}
+		exportKernel(args[1], expandPath(args[2]))
+	case "import":
+		names := positional(args[1:])
+		if len(names) < 1 {
+			printErrorCode(codeUsage, "Usage: cloudlab kernel import <file> [--force]")
+			return
+		}
+		forceFlag = hasFlag(args, "--force")
+		importKernel(expandPath(names[0]))
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+args[0])
+	}
+}
+
+func listKernels() {
+	printHeader("📓 JUPYTER KERNELS")
+	jp := getJupyterPath()
+	if _, err := os.Stat(jp); err != nil {
+		printErrorCode(codeNotInstalled, "Jupyter not installed")
+		return
+	}
+	cmd := exec.Command(jp, "kernelspec", "list")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Run()
+}
+
+// addKernel creates the env and kernelspec. torch is "auto" to install
+// PyTorch when a GPU backend is enabled, as the main env does, or
+// "yes"/"no" to override that for this kernel.
+func addKernel(name, ver, displayName string, systemSite bool, torch string) {
+	python, err := pythonFor(ver)
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	printStep(fmt.Sprintf("Creating kernel %s with Python %s...", name, python))
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found")
+		return
+	}
+
+	if torch == "yes" && offlineFlag && !offlineHasTorch() {
+		printErrorCode(codeNotFound, "--gpu: no torch wheel in "+filepath.Join(config.OfflineDir, "wheels")+". Add one, or use --no-gpu")
+		return
+	}
+
+	env := envPath(name)
+	if !prepareEnvDir(name, env) {
+		return
+	}
+	if err := runCmd("uv venv", command(uv, venvArgs(env, python, systemSite)...)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	py := envPython(env)
+
+	args := append([]string{"pip", "install", "ipykernel", "--python", py}, uvOfflineArgs()...)
+	if err := runCmd("pip install ipykernel", command(uv, args...)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	if torch != "no" {
+		cmd := torchCmd(uv, py)
+		if cmd == nil && torch == "yes" {
+			// No GPU backend configured: the CPU build, not the CUDA wheels.
+			cmd = cpuTorchCmd(uv, py)
+		}
+		if cmd != nil {
+			printStep("Installing PyTorch (skip with --no-gpu)...")
+			if err := runCmd("pip install torch", cmd); err != nil {
+				printWarning(err.Error())
+			}
+		}
+	}
+	if displayName == "" {
+		// Label with the version the venv got; --python-path leaves ver empty.
+		cfg := readPyvenvCfg(env)
+		v := cfg["version_info"]
+		if v == "" {
+			v = cfg["version"]
+		}
+		if v == "" && !strings.ContainsAny(python, `/\`) {
+			v = python
+		}
+		displayName = "Python (" + name + ")"
+		if v != "" {
+			displayName = fmt.Sprintf("Python %s (%s)", v, name)
+		}
+	}
+	if err := runCmd("ipykernel install", command(py, "-m", "ipykernel", "install", "--user", "--name", name, "--display-name", displayName)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+
+	printSuccess(fmt.Sprintf("Kernel %s created", name))
+}
+
+func showKernelInfo(name string) {
+	env := envPath(name)
+	cfg := readPyvenvCfg(env)
+	if cfg == nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return
+	}
+	printHeader("📓 KERNEL " + name)
+	fmt.Printf("  %-22s : %s%s%s\n", "path", BrightBlue, env, Reset)
+	version := cfg["version_info"]
+	if version == "" {
+		version = cfg["version"]
+	}
+	fmt.Printf("  %-22s : %s%s%s\n", "python", BrightYellow, version, Reset)
+	systemSite := cfg["include-system-site-packages"] == "true"
+	fmt.Printf("  %-22s : %s%v%s\n", "system-site-packages", boolColor(systemSite), systemSite, Reset)
+	fmt.Println()
+}
+
+// kernelBundle is what `kernel export` writes: the kernelspec exactly as
+// Jupyter sees it, plus what's needed to rebuild the env behind it.
+type kernelBundle struct {
+	Name         string         `json:"name"`
+	Python       string         `json:"python_version"`
+	SystemSite   bool           `json:"system_site_packages,omitempty"`
+	Requirements []string       `json:"requirements"`
+	KernelSpec   map[string]any `json:"kernelspec"`
+}
+
+// kernelSpecDir asks Jupyter (through the env's own python) where a
+// kernelspec lives.
+func kernelSpecDir(py, name string) (string, error) {
+	out, err := command(py, "-m", "jupyter", "kernelspec", "list", "--json").Output()
+	if err != nil {
+		return "", fmt.Errorf("jupyter kernelspec list: %w", err)
+	}
+	var list struct {
+		Kernelspecs map[string]struct {
+			ResourceDir string `json:"resource_dir"`
+		} `json:"kernelspecs"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return "", fmt.Errorf("jupyter kernelspec list: %w", err)
+	}
+	spec, ok := list.Kernelspecs[name]
+	if !ok {
+		return "", fmt.Errorf("kernelspec %s is not registered with Jupyter", name)
+	}
+	return spec.ResourceDir, nil
+}
+
+func exportKernel(name, file string) {
+	printStep("Exporting kernel " + name + "...")
+	env := envPath(name)
+	cfg := readPyvenvCfg(env)
+	if cfg == nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return
+	}
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found. Run: cloudlab install uv")
+		return
+	}
+	py := envPython(env)
+	dir, err := kernelSpecDir(py, name)
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	b := kernelBundle{Name: name, Python: cfg["version_info"], SystemSite: cfg["include-system-site-packages"] == "true"}
+	if b.Python == "" {
+		b.Python = cfg["version"]
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "kernel.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &b.KernelSpec)
+	}
+	if err != nil {
+		printErrorCode(errCode(err), "Failed to read kernel.json: "+err.Error())
+		return
+	}
+
+	var out bytes.Buffer
+	freeze := command(uv, "pip", "freeze", "--python", py)
+	freeze.Stdout = &out
+	if err := runCmd("uv pip freeze", freeze); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "-e ") || strings.Contains(line, " @ file://"):
+			printWarning("Skipping local package (won't exist elsewhere): " + line)
+		default:
+			b.Requirements = append(b.Requirements, line)
+		}
+	}
+
+	data, _ = json.MarshalIndent(b, "", "  ")
+	if err := os.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	printSuccess(fmt.Sprintf("Exported %s (Python %s, %d packages) to %s", name, b.Python, len(b.Requirements), file))
+}
+
+func importKernel(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	var b kernelBundle
+	if err := json.Unmarshal(data, &b); err != nil || b.KernelSpec == nil {
+		printError("Not a kernel export: " + file)
+		return
+	}
+	if !regexp.MustCompile(`^[a-zA-Z0-9._-]+$`).MatchString(b.Name) {
+		printErrorCode(codeInvalid, fmt.Sprintf("Invalid kernel name in %s: %q", file, b.Name))
+		return
+	}
+	python, err := pythonFor(b.Python)
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	printStep(fmt.Sprintf("Importing kernel %s with Python %s...", b.Name, python))
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found. Run: cloudlab install uv")
+		return
+	}
+	env := envPath(b.Name)
+	if !prepareEnvDir(b.Name, env) {
+		return
+	}
+	if err := runCmd("uv venv", command(uv, venvArgs(env, python, b.SystemSite)...)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	py := envPython(env)
+
+	req := filepath.Join(env, "cloudlab-requirements.txt")
+	if err := os.WriteFile(req, []byte(strings.Join(b.Requirements, "\n")+"\n"), 0644); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return
+	}
+	printStep(fmt.Sprintf("Installing %d packages...", len(b.Requirements)))
+	if err := runCmd("uv pip install", command(uv, "pip", "install", "-r", req, "ipykernel", "--python", py)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+
+	// Register through ipykernel so the logos are in place, then put the
+	// exported kernel.json back with the interpreter pointing at the new env.
+	display, _ := b.KernelSpec["display_name"].(string)
+	if display == "" {
+		display = b.Name
+	}
+	if err := runCmd("ipykernel install", command(py, "-m", "ipykernel", "install", "--user", "--name", b.Name, "--display-name", display)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	dir, err := kernelSpecDir(py, b.Name)
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	if argv, ok := b.KernelSpec["argv"].([]any); ok && len(argv) > 0 {
+		if exe, _ := argv[0].(string); strings.HasPrefix(strings.ToLower(filepath.Base(exe)), "python") {
+			argv[0] = py
+		} else {
+			printWarning(fmt.Sprintf("Kept argv[0] %q as exported; make sure it exists here", exe))
+		}
+	}
+	data, _ = json.MarshalIndent(b.KernelSpec, "", " ")
+	if err := os.WriteFile(filepath.Join(dir, "kernel.json"), append(data, '\n'), 0644); err != nil {
+		printErrorCode(errCode(err), "Failed to write kernel.json: "+err.Error())
+		return
+	}
+	printSuccess(fmt.Sprintf("Kernel %s (%s) imported", b.Name, display))
+}
+
+func removeKernel(name string) {
+	printStep("Removing kernel " + name + "...")
+	jp := getJupyterPath()
+	if jp != "" {
+		command(jp, "kernelspec", "uninstall", name, "-f").Run()
+	}
+	removeEnvDir(name)
+	printSuccess("Kernel removed")
+}
+
+// ==================== Environments ====================
+
+func handleEnv(args []string) {
+	switch args[0] {
+	case "list":
+		listEnvs()
+	case "create":
+		names := positional(args[1:], "--dir")
+		if len(names) == 0 || (len(names) < 2 && pythonFlag == "" && config.PythonExe == "") {
+			printErrorCode(codeUsage, "Usage: cloudlab env create <name> <version|--python-path <python>> [--dir <path>] [--system-site-packages] [--torch]")
+			return
+		}
+		if dir := flagValue(args, "--dir"); dir != "" && !setEnvDir(names[0], dir) {
+			return
+		}
+		ver := ""
+		if len(names) > 1 {
+			ver = names[1]
+		}
+		forceFlag = hasFlag(args, "--force")
+		createEnv(names[0], ver, hasFlag(args, "--system-site-packages"), hasFlag(args, "--torch"))
+		if hasFlag(args, "--dir") {
+			saveEnvDir(names[0])
+		}
+	case "remove", "rm":
+		if hasFlag(args, "--all-unused") {
+			removeUnusedEnvs(hasFlag(args, "--yes", "-y"))
+			return
+		}
+		if len(args) < 2 {
+			printErrorCode(codeUsage, "Usage: cloudlab env remove <name> | --all-unused [--yes]")
+			return
+		}
+		removeEnvDir(args[1])
+		if args[1] == config.DefaultEnv {
+			config.DefaultEnv = ""
+			saveConfig()
+			printInfo("Default environment reset to cloudlab")
+		}
+		printSuccess("Environment removed")
+	case "install":
+		if len(args) < 2 {
+			printErrorCode(codeUsage, "Usage: cloudlab env install <package>")
+			return
+		}
+		installPkg(strings.Join(args[1:], " "))
+	case "shell":
+		if len(args) < 2 {
+			printErrorCode(codeUsage, "Usage: cloudlab env shell <name>")
+			return
+		}
+		envShell(args[1])
+	case "run":
+		cmdArgs := args[min(2, len(args)):]
+		for i, a := range args {
+			if a == "--" {
+				cmdArgs = args[i+1:]
+				break
+			}
+		}
+		if len(args) < 2 || args[1] == "--" || len(cmdArgs) == 0 {
+			printErrorCode(codeUsage, "Usage: cloudlab env run <name> -- <command> [args...]")
+			return
+		}
+		exit(envRun(args[1], cmdArgs))
+	case "pip":
+		var pipArgs []string
+		for i, a := range args {
+			if a == "--" {
+				pipArgs = args[i+1:]
+				break
+			}
+		}
+		if len(args) < 2 || args[1] == "--" || len(pipArgs) == 0 {
+			printErrorCode(codeUsage, "Usage: cloudlab env pip <name> -- <uv pip args...>")
+			return
+		}
+		exit(envPip(args[1], pipArgs))
+	case "default":
+		if len(args) < 2 {
+			printInfo("Default environment: " + envName(config.DefaultEnv))
+			return
+		}
+		setDefaultEnv(args[1])
+	case "upgrade":
+		names := positional(args[1:])
+		if len(names) < 1 {
+			printErrorCode(codeUsage, "Usage: cloudlab env upgrade <name> [--dry-run]")
+			return
+		}
+		envUpgrade(names[0], hasFlag(args, "--dry-run"))
+	case "requirements", "reqs":
+		envRequirements(args[1:])
+	case "size", "du":
+		if len(args) > 1 {
+			envSize([]string{args[1]})
+		} else {
+			envSize(envNames())
+		}
+	default:
+		printErrorCode(codeUnknown, "Unknown: "+args[0])
+	}
+}
+
+func envRun(name string, cmdArgs []string) int {
+	env := envPath(name)
+	if _, err := os.Stat(envPython(env)); err != nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return 1
+	}
+
+	bin := cmdArgs[0]
+	if filepath.Base(bin) == bin {
+		for _, candidate := range []string{bin, bin + ".exe"} {
+			if _, err := os.Stat(filepath.Join(envBinDir(env), candidate)); err == nil {
+				bin = filepath.Join(envBinDir(env), candidate)
+				break
+			}
+		}
+	}
+
+	cmd := exec.Command(bin, cmdArgs[1:]...)
+	cmd.Env = envEnviron(env)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return 127
+	}
+	return 0
+}
+
+// envPip runs `uv pip <args> --python <env python>` and returns uv's exit code.
+func envPip(name string, pipArgs []string) int {
+	py := envPython(envPath(name))
+	if _, err := os.Stat(py); err != nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return 1
+	}
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found. Run: cloudlab install uv")
+		return 1
+	}
+	cmd := exec.Command(uv, append(append([]string{"pip"}, pipArgs...), "--python", py)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return 127
+	}
+	return 0
+}
+
+// Each env can track its own requirements.txt. `env requirements` edits
+// it and installs in one go, and sync brings the env back in line with it.
+// The file lives outside the venv, so it survives env create --force and
+// env remove and can rebuild the env afterwards.
+
+func requirementsPath(name string) string {
+	if name == "default" {
+		name = envName(config.DefaultEnv)
+	}
+	return filepath.Join(cloudlabDir, "requirements", name+".txt")
+}
+
+var reqNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*`)
+
+// reqName is a requirement's normalized project name (PEP 503), so
+// "Foo_Bar>=1" and "foo-bar" count as the same package.
+func reqName(spec string) string {
+	name := reqNameRe.FindString(strings.TrimSpace(spec))
+	return strings.ToLower(strings.NewReplacer("_", "-", ".", "-").Replace(name))
+}
+
+func readRequirements(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimRight(string(data), "\n")
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+func writeRequirements(path string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func envRequirements(args []string) {
+	usage := "Usage: cloudlab env requirements <list|add|remove|sync> <env> [packages...] [--exact]"
+	names := positional(args)
+	if len(names) < 2 {
+		printErrorCode(codeUsage, usage)
+		return
+	}
+	action, name, pkgs := names[0], names[1], names[2:]
+	py := envPython(envPath(name))
+	if _, err := os.Stat(py); err != nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return
+	}
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found")
+		return
+	}
+	path := requirementsPath(name)
+	// Older versions kept the file inside the venv.
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if data, err := os.ReadFile(filepath.Join(envPath(name), "requirements.txt")); err == nil {
+			os.MkdirAll(filepath.Dir(path), 0755)
+			os.WriteFile(path, data, 0644)
+		}
+	}
+	lines, err := readRequirements(path)
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+
+	switch action {
+	case "list", "ls":
+		if len(lines) == 0 {
+			printInfo("No tracked requirements. Add some: cloudlab env requirements add " + name + " <package>")
+			return
+		}
+		fmt.Println(strings.Join(lines, "\n"))
+	case "add":
+		if len(pkgs) == 0 {
+			printErrorCode(codeUsage, usage)
+			return
+		}
+		for _, pkg := range pkgs {
+			replaced := false
+			for i, line := range lines {
+				if reqName(line) == reqName(pkg) {
+					lines[i], replaced = pkg, true
+				}
+			}
+			if !replaced {
+				lines = append(lines, pkg)
+			}
+		}
+		printStep("Installing " + strings.Join(pkgs, " ") + "...")
+		if err := runCmd("pip install", command(uv, append(append([]string{"pip", "install"}, pkgs...), "--python", py)...)); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+		if err := writeRequirements(path, lines); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+		printSuccess("Added to " + path)
+	case "remove", "rm":
+		if len(pkgs) == 0 {
+			printErrorCode(codeUsage, usage)
+			return
+		}
+		drop := map[string]bool{}
+		for _, pkg := range pkgs {
+			drop[reqName(pkg)] = true
+		}
+		kept := lines[:0]
+		for _, line := range lines {
+			if !drop[reqName(line)] {
+				kept = append(kept, line)
+			}
+		}
+		if err := writeRequirements(path, kept); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+		printStep("Uninstalling " + strings.Join(pkgs, " ") + "...")
+		if err := runCmd("pip uninstall", command(uv, append(append([]string{"pip", "uninstall"}, pkgs...), "--python", py)...)); err != nil {
+			printWarning(err.Error())
+		}
+		printSuccess("Removed from " + path)
+	case "sync":
+		if len(lines) == 0 {
+			printError("Nothing to sync: " + path + " is empty or missing")
+			return
+		}
+		if !hasFlag(args, "--exact") {
+			printStep("Installing " + path + "...")
+			if err := runCmd("pip install", command(uv, "pip", "install", "-r", path, "--python", py)); err != nil {
+				printErrorCode(errCode(err), err.Error())
+				return
+			}
+			printSuccess(name + " has everything in requirements.txt (--exact also removes extras)")
+			return
+		}
+		// uv pip sync removes anything unlisted, dependencies included. Keep
+		// the kernel (and in the main venv, Jupyter) and resolve the full set.
+		keep := map[string]bool{"ipykernel": true}
+		if envPath(name) == envPath("cloudlab") {
+			for _, p := range []string{"jupyterlab", "jupyter-server", "notebook", "ipywidgets"} {
+				keep[p] = true
+			}
+		}
+		for _, line := range lines {
+			delete(keep, reqName(line))
+		}
+		want := append([]string{}, lines...)
+		if installed, err := envPackages(uv, py); err == nil {
+			for _, p := range installed {
+				if keep[reqName(p.Name)] {
+					want = append(want, reqName(p.Name))
+				}
+			}
+		}
+		tmp, err := os.CreateTemp("", "cloudlab-sync-*.txt")
+		if err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+		locked := tmp.Name() + ".lock"
+		defer os.Remove(tmp.Name())
+		defer os.Remove(locked)
+		tmp.WriteString(strings.Join(want, "\n") + "\n")
+		tmp.Close()
+		if err := runCmd("pip compile", command(uv, "pip", "compile", tmp.Name(), "-o", locked, "--python", py, "--quiet")); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+		printStep("Syncing " + name + " to exactly " + path + "...")
+		if err := runCmd("pip sync", command(uv, "pip", "sync", locked, "--python", py)); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
+		printSuccess(name + " now matches requirements.txt")
+	default:
+		printErrorCode(codeUsage, usage)
+	}
+}
+
+type envPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Latest  string `json:"latest_version"`
+}
+
+func envPackages(uv, py string, extra ...string) ([]envPackage, error) {
+	args := append([]string{"pip", "list", "--format", "json", "--python", py}, extra...)
+	out, err := exec.Command(uv, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []envPackage
+	err = json.Unmarshal(out, &pkgs)
+	return pkgs, err
+}
+
+func envUpgrade(name string, dryRun bool) {
+	env := envPath(name)
+	py := envPython(env)
+	if _, err := os.Stat(py); err != nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return
+	}
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found")
+		return
+	}
+
+	if dryRun {
+		printStep("Checking " + name + " for outdated packages...")
+		outdated, err := envPackages(uv, py, "--outdated")
+		if err != nil {
+			printErrorCode(errCode(err), "Failed to list packages: "+err.Error())
+			return
+		}
+		if len(outdated) == 0 {
+			printSuccess("Everything is up to date")
+			return
+		}
+		for _, p := range outdated {
+			fmt.Printf("  %-30s %s → %s%s%s\n", p.Name, p.Version, BrightGreen, p.Latest, Reset)
+		}
+		printInfo(fmt.Sprintf("%d packages would be upgraded", len(outdated)))
+		return
+	}
+
+	before, err := envPackages(uv, py)
+	if err != nil {
+		printErrorCode(errCode(err), "Failed to list packages: "+err.Error())
+		return
+	}
+	if len(before) == 0 {
+		printInfo("No packages installed in " + name)
+		return
+	}
+	printStep(fmt.Sprintf("Upgrading %d packages in %s...", len(before), name))
+	args := []string{"pip", "install", "--upgrade", "--python", py}
+	for _, p := range before {
+		args = append(args, p.Name)
+	}
+	cmd := exec.Command(uv, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := runCmd("pip install --upgrade", cmd); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+
+	after, _ := envPackages(uv, py)
+	old := map[string]string{}
+	for _, p := range before {
+		old[p.Name] = p.Version
+	}
+	upgraded := 0
+	for _, p := range after {
+		if v, ok := old[p.Name]; ok && v != p.Version {
+			fmt.Printf("  %-30s %s → %s%s%s\n", p.Name, v, BrightGreen, p.Version, Reset)
+			upgraded++
+		}
+	}
+	if upgraded == 0 {
+		printSuccess("Everything is up to date")
+		return
+	}
+	printSuccess(fmt.Sprintf("Upgraded %d packages", upgraded))
+}
 
-	// Start tunnels
-	services := []struct {
-		name string
-		port int
-	}{
-		{"jupyter", config.JupyterPort},
-		{"vscode", config.VSCodePort},
-		{"ssh", config.SSHPort},
-		{"dashboard", config.DashboardPort},
+func envShell(name string) {
+	env := envPath(name)
+	if _, err := os.Stat(envPython(env)); err != nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return
 	}
 
-	for _, svc := range services {
-		if !isRunning(svc.name) && svc.name != "dashboard" {
-			continue
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		shell := os.Getenv("COMSPEC")
+		if shell == "" {
+			shell = "cmd.exe"
 		}
-		go func(name string, port int) {
-			logPath := filepath.Join(cloudlabDir, "logs", "tunnel_"+name+".log")
-			logFile, _ := os.Create(logPath)
-			cmd := exec.Command(cf, "tunnel", "--url", fmt.Sprintf("http://localhost:%d", port))
-			cmd.Stdout = logFile
-			cmd.Stderr = logFile
-			if err := cmd.Start(); err == nil && cmd.Process != nil {
-				savePID("tunnel_"+name, cmd.Process.Pid)
-			}
-			time.Sleep(8 * time.Second)
-			extractURL(name, logPath)
-		}(svc.name, svc.port)
+		cmd = exec.Command(shell)
+	} else {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		cmd = exec.Command(shell, "-i")
 	}
+	cmd.Env = envEnviron(env)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 
-	fmt.Printf("  %s⏳%s Waiting for tunnel URLs...\n", BrightYellow, Reset)
-	time.Sleep(15 * time.Second)
-
-	loadConfig()
-	showTunnelStatus()
-
-	if config.NotifyOnStart && config.Email != "" && config.EmailPassword != "" {
-		sendTunnelEmail()
-	}
+	printInfo(fmt.Sprintf("Entering %s%s%s (type 'exit' to leave)", BrightGreen, name, Reset))
+	cmd.Run()
+	printInfo("Left " + name)
 }
 
-func extractURL(name, logPath string) {
-	for i := 0; i < 30; i++ {
-		data, err := os.ReadFile(logPath)
-		if err == nil {
-			re := regexp.MustCompile(`https://[a-zA-Z0-9-]+\.trycloudflare\.com`)
-			matches := re.FindAllString(string(data), -1)
-			if len(matches) > 0 {
-				url := matches[len(matches)-1]
-				switch name {
-				case "jupyter":
-					config.TunnelURLs.Jupyter = url
-				case "vscode":
-					config.TunnelURLs.VSCode = url
-				case "ssh":
-					config.TunnelURLs.SSH = url
-				case "dashboard":
-					config.TunnelURLs.Dashboard = url
-				}
-				saveConfig()
-				return
+func listEnvs() {
+	printHeader("🐍 ENVIRONMENTS")
+	venv := filepath.Join(cloudlabDir, "venv")
+	if _, err := os.Stat(venv); err == nil {
+		if config.DefaultEnv == "" {
+			fmt.Printf("  %s★%s cloudlab (default)\n", BrightYellow, Reset)
+		} else {
+			fmt.Printf("  %s○%s cloudlab\n", Dim, Reset)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(cloudlabDir, "envs"))
+	for _, e := range entries {
+		if _, mapped := config.EnvDirs[e.Name()]; e.IsDir() && !mapped {
+			note := ""
+			if readPyvenvCfg(filepath.Join(cloudlabDir, "envs", e.Name()))["include-system-site-packages"] == "true" {
+				note = fmt.Sprintf(" %s(system site packages)%s", Dim, Reset)
 			}
+			printEnvLine(e.Name(), note)
 		}
-		time.Sleep(1 * time.Second)
 	}
-}
-
-func stopAllTunnels() {
-	stopPID("tunnel_jupyter")
-	stopPID("tunnel_vscode")
-	stopPID("tunnel_ssh")
-	stopPID("tunnel_dashboard")
-	config.TunnelURLs = TunnelURLs{}
-	saveConfig()
-	printSuccess("Tunnels stopped")
-}
-
-func showTunnelStatus() {
-	loadConfig()
-	printHeader("🌐 TUNNEL URLS")
-
-	printTunnelLine("🐍 Jupyter", config.TunnelURLs.Jupyter, isRunning("tunnel_jupyter"))
-	printTunnelLine("💻 VS Code", config.TunnelURLs.VSCode, isRunning("tunnel_vscode"))
-	printTunnelLine("🔒 SSH", config.TunnelURLs.SSH, isRunning("tunnel_ssh"))
-	printTunnelLine("📊 Dashboard", config.TunnelURLs.Dashboard, isRunning("tunnel_dashboard"))
+	names := make([]string, 0, len(config.EnvDirs))
+	for name := range config.EnvDirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		note := fmt.Sprintf(" %s→ %s%s", Dim, config.EnvDirs[name], Reset)
+		if readPyvenvCfg(config.EnvDirs[name]) == nil {
+			note += fmt.Sprintf(" %s(missing)%s", BrightRed, Reset)
+		}
+		printEnvLine(name, note)
+	}
 	fmt.Println()
 }
 
-func printTunnelLine(name, url string, running bool) {
-	status := fmt.Sprintf("%s[Stopped]%s", BrightRed, Reset)
-	if running {
-		status = fmt.Sprintf("%s[Running]%s", BrightGreen, Reset)
+// envNames lists every environment CloudLab knows about: the main venv,
+// everything under envs/ and any env created with --dir.
+func envNames() []string {
+	var names []string
+	if _, err := os.Stat(envPath("cloudlab")); err == nil {
+		names = append(names, "cloudlab")
 	}
-	if url != "" {
-		fmt.Printf("  %-12s %s\n", name, status)
-		fmt.Printf("    └─ %s%s%s\n", BrightMagenta+Underline, url, Reset)
-	} else {
-		fmt.Printf("  %-12s %s %s(no tunnel)%s\n", name, status, Dim, Reset)
+	entries, _ := os.ReadDir(filepath.Join(cloudlabDir, "envs"))
+	for _, e := range entries {
+		// A --dir mapping shadows envs/<name>; it's listed with the mapped ones.
+		if _, mapped := config.EnvDirs[e.Name()]; e.IsDir() && !mapped {
+			names = append(names, e.Name())
+		}
 	}
-}
-
-// ==================== SSH ====================
-
-func handleSSH(action string) {
-	switch action {
-	case "start":
-		startSSH()
-	case "stop":
-		stopPID("ssh")
-		printSuccess("SSH stopped")
-	case "config":
-		configureSSH()
-	case "status":
-		showSSHStatus()
-	default:
-		printError("Unknown: " + action)
+	var mapped []string
+	for name := range config.EnvDirs {
+		mapped = append(mapped, name)
 	}
+	sort.Strings(mapped)
+	return append(names, mapped...)
 }
 
-func configureSSH() {
-	printHeader("🔒 SSH CONFIG")
-	reader := bufio.NewReader(os.Stdin)
+func dirSize(dir string) (uint64, error) {
+	var total uint64
+	err := filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	return total, err
+}
 
-	fmt.Printf("  SSH port [%d]: ", config.SSHPort)
-	if input := readLine(reader); input != "" {
-		config.SSHPort, _ = strconv.Atoi(input)
+// kernelEnvDirs returns the directories of the pythons that registered
+// kernelspecs start, keyed by kernel name.
+func kernelEnvDirs(jp string) (map[string]string, error) {
+	out, err := command(jp, "kernelspec", "list", "--json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("jupyter kernelspec list: %w", err)
 	}
-
-	fmt.Printf("  SSH username [%s]: ", config.SSHUser)
-	if input := readLine(reader); input != "" {
-		config.SSHUser = input
+	var list struct {
+		Kernelspecs map[string]struct {
+			Spec struct {
+				Argv []string `json:"argv"`
+			} `json:"spec"`
+		} `json:"kernelspecs"`
 	}
-
-	fmt.Printf("  SSH password (optional): ")
-	if input := readLine(reader); input != "" {
-		config.SSHPassword = input
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("jupyter kernelspec list: %w", err)
 	}
-
-	saveConfig()
-	printSuccess("SSH configured")
-}
-
-func showSSHStatus() {
-	printHeader("🔒 SSH STATUS")
-	if isRunning("ssh") {
-		fmt.Printf("  %s●%s SSH Terminal %s[Running]%s port %s%d%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.SSHPort, Reset)
-		fmt.Printf("    └─ http://localhost:%d\n", config.SSHPort)
-		if config.TunnelURLs.SSH != "" {
-			fmt.Printf("    └─ %s%s%s\n", BrightMagenta, config.TunnelURLs.SSH, Reset)
+	dirs := map[string]string{}
+	for name, ks := range list.Kernelspecs {
+		if len(ks.Spec.Argv) > 0 {
+			dirs[name] = filepath.Dir(filepath.Dir(ks.Spec.Argv[0]))
 		}
-	} else {
-		fmt.Printf("  %s○%s SSH Terminal %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
 	}
-	fmt.Println()
+	return dirs, nil
 }
 
-// ==================== Dashboard ====================
+// removeUnusedEnvs deletes envs under envs/ that no kernelspec, project or
+// default_env points at.
+func removeUnusedEnvs(yes bool) {
+	jp := getJupyterPath()
+	if _, err := os.Stat(jp); err != nil {
+		printErrorCode(codeNotInstalled, "Jupyter not installed, so kernels can't be checked. Run: cloudlab install jupyter")
+		return
+	}
+	kernels, err := kernelEnvDirs(jp)
+	if err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	used := map[string]bool{}
+	for name, dir := range kernels {
+		used[name] = true
+		if rel, err := filepath.Rel(filepath.Join(cloudlabDir, "envs"), dir); err == nil && !strings.HasPrefix(rel, "..") {
+			used[strings.SplitN(rel, string(filepath.Separator), 2)[0]] = true
+		}
+	}
+	used[config.DefaultEnv] = true
+	for _, proj := range config.Projects {
+		used[proj.Env] = true
+	}
 
-func handleDashboard(action string) {
-	switch action {
-	case "start":
-		startDashboard()
-	case "stop":
-		stopPID("dashboard")
-		printSuccess("Dashboard stopped")
-	case "status":
-		showDashboardStatus()
-	default:
-		printError("Unknown: " + action)
+	printHeader("🧹 UNUSED ENVIRONMENTS")
+	var unused []string
+	var total uint64
+	// Work on envs/<name> itself: envPath may point an env_dirs name elsewhere.
+	envsDir := filepath.Join(cloudlabDir, "envs")
+	entries, _ := os.ReadDir(envsDir)
+	for _, e := range entries {
+		if !e.IsDir() || used[e.Name()] {
+			continue
+		}
+		unused = append(unused, e.Name())
+		n, _ := dirSize(filepath.Join(envsDir, e.Name()))
+		total += n
+		fmt.Printf("  %-20s %s%10s%s\n", e.Name(), BrightCyan, formatBytes(n), Reset)
+	}
+	setJSONData(unused)
+	if len(unused) == 0 {
+		printSuccess("Every environment has a kernel")
+		return
+	}
+	fmt.Printf("  %-20s %s%10s%s\n\n", "total", Bold, formatBytes(total), Reset)
+	if !yes {
+		fmt.Printf("%sRemove %d environment(s) without a registered kernel?%s [y/N]: ", BrightYellow, len(unused), Reset)
+		if strings.ToLower(readLine(bufio.NewReader(os.Stdin))) != "y" {
+			printInfo("Cancelled")
+			return
+		}
+	}
+	for _, name := range unused {
+		if err := os.RemoveAll(filepath.Join(envsDir, name)); err != nil {
+			printErrorCode(errCode(err), "Failed to remove "+name+": "+err.Error())
+			continue
+		}
+		printSuccess("Removed " + name)
 	}
+	printSuccess("Freed " + formatBytes(total))
 }
 
-func showDashboardStatus() {
-	printHeader("📊 DASHBOARD STATUS")
-	if isRunning("dashboard") {
-		fmt.Printf("  %s●%s Dashboard %s[Running]%s port %s%d%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.DashboardPort, Reset)
-		fmt.Printf("    └─ http://localhost:%d\n", config.DashboardPort)
-		if config.TunnelURLs.Dashboard != "" {
-			fmt.Printf("    └─ %s%s%s\n", BrightMagenta, config.TunnelURLs.Dashboard, Reset)
+func envSize(names []string) {
+	printHeader("💾 ENVIRONMENT SIZES")
+	var total uint64
+	for _, name := range names {
+		env := envPath(name)
+		if name != "cloudlab" && readPyvenvCfg(env) == nil {
+			printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+			continue
 		}
-	} else {
-		fmt.Printf("  %s○%s Dashboard %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+		n, err := dirSize(env)
+		if err != nil {
+			printWarning(name + ": " + err.Error())
+			continue
+		}
+		total += n
+		fmt.Printf("  %-20s %s%10s%s  %s%s%s\n", name, BrightCyan, formatBytes(n), Reset, Dim, env, Reset)
+	}
+	if len(names) > 1 {
+		fmt.Printf("  %-20s %s%10s%s\n", "total", Bold, formatBytes(total), Reset)
 	}
 	fmt.Println()
 }
 
-// ==================== Status ====================
-
-func showStatus() {
-	fmt.Println(getLogo())
-	printHeader("📊 SERVICE STATUS")
-
-	// Jupyter
-	if isRunning("jupyter") {
-		fmt.Printf("  %s●%s Jupyter %s %s[Running]%s port %s%d%s\n", BrightGreen, Reset, config.JupyterMode, BrightGreen, Reset, BrightCyan, config.JupyterPort, Reset)
+func printEnvLine(name, note string) {
+	if name == config.DefaultEnv {
+		fmt.Printf("  %s★%s %s (default)%s\n", BrightYellow, Reset, name, note)
 	} else {
-		fmt.Printf("  %s○%s Jupyter %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+		fmt.Printf("  %s○%s %s%s\n", Dim, Reset, name, note)
 	}
+}
 
-	// VS Code
-	if isRunning("vscode") {
-		fmt.Printf("  %s●%s VS Code %s[Running]%s port %s%d%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.VSCodePort, Reset)
-	} else {
-		fmt.Printf("  %s○%s VS Code %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+func setDefaultEnv(name string) {
+	if name != "cloudlab" && readPyvenvCfg(envPath(name)) == nil {
+		printErrorCode(codeNotFound, "Environment not found: "+name+". Run: cloudlab env list")
+		return
 	}
-
-	// SSH
-	if isRunning("ssh") {
-		fmt.Printf("  %s●%s SSH Terminal %s[Running]%s port %s%d%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.SSHPort, Reset)
-	} else {
-		fmt.Printf("  %s○%s SSH Terminal %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+	if name == "cloudlab" {
+		name = ""
 	}
-
-	// Dashboard
-	if isRunning("dashboard") {
-		fmt.Printf("  %s●%s Dashboard %s[Running]%s port %s%d%s\n", BrightGreen, Reset, BrightGreen, Reset, BrightCyan, config.DashboardPort, Reset)
-	} else {
-		fmt.Printf("  %s○%s Dashboard %s[Stopped]%s\n", BrightRed, Reset, BrightRed, Reset)
+	config.DefaultEnv = name
+	saveConfig()
+	printSuccess("Default environment: " + envName(config.DefaultEnv))
+	if filepath.Dir(getJupyterPath()) != envBinDir(envPath("default")) {
+		printInfo("Jupyter isn't installed there, so it keeps running from the cloudlab venv. Run: cloudlab env install jupyterlab")
 	}
+	if isRunning("jupyter") {
+		printInfo("Restart Jupyter to pick it up: cloudlab restart jupyter")
+	}
+}
 
-	showTunnelStatus()
-
-	printHeader("🔐 CREDENTIALS")
-	fmt.Printf("  Jupyter:   %s%s%s\n", BrightYellow, config.JupyterPassword, Reset)
-	fmt.Printf("  VS Code:   %s%s%s\n", BrightYellow, config.VSCodePassword, Reset)
-	fmt.Printf("  SSH User:  %s%s%s\n", BrightYellow, config.SSHUser, Reset)
-	if config.SSHPassword != "" {
-		fmt.Printf("  SSH Pass:  %s%s%s\n", BrightYellow, config.SSHPassword, Reset)
+func envName(name string) string {
+	if name == "" {
+		return "cloudlab"
 	}
-	fmt.Println()
+	return name
 }
 
-func showLogs(service string) {
-	logPath := filepath.Join(cloudlabDir, "logs", service+".log")
-	data, err := os.ReadFile(logPath)
+func createEnv(name, ver string, systemSite, torch bool) {
+	python, err := pythonFor(ver)
 	if err != nil {
-		printError("Log not found: " + logPath)
+		printErrorCode(errCode(err), err.Error())
 		return
 	}
-	fmt.Printf("\n%s=== %s logs ===%s\n\n", BrightCyan, service, Reset)
-	fmt.Println(string(data))
-}
-
-// ==================== Kernels ====================
-
-func handleKernel(args []string) {
-	switch args[0] {
-	case "list":
-		listKernels()
-	case "add":
-		if len(args) < 2 {
-			printError("Usage: cloudlab kernel add <name> [version]")
-			return
-		}
-		ver := config.PythonVersion
-		if len(args) > 2 {
-			ver = args[2]
+	printStep(fmt.Sprintf("Creating %s with Python %s...", name, python))
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found")
+		return
+	}
+	env := envPath(name)
+	if !prepareEnvDir(name, env) {
+		return
+	}
+	if err := runCmd("uv venv", command(uv, venvArgs(env, python, systemSite)...)); err != nil {
+		printErrorCode(errCode(err), err.Error())
+		return
+	}
+	if torch {
+		py := envPython(env)
+		cmd, backend := torchCmd(uv, py), "CPU"
+		switch {
+		case cmd == nil:
+			cmd = cpuTorchCmd(uv, py)
+		case config.EnableMPS:
+			backend = "MPS"
+		case config.EnableCUDA:
+			backend = "CUDA"
 		}
-		addKernel(args[1], ver)
-	case "remove", "rm":
-		if len(args) < 2 {
-			printError("Usage: cloudlab kernel remove <name>")
+		printStep("Installing PyTorch (" + backend + ")...")
+		if err := runCmd("pip install torch", cmd); err != nil {
+			printErrorCode(errCode(err), err.Error())
 			return
 		}
-		removeKernel(args[1])
-	default:
-		printError("Unknown: " + args[0])
 	}
+	printSuccess("Environment created at " + env)
 }
 
-func listKernels() {
-	printHeader("📓 JUPYTER KERNELS")
+// prepareEnvDir refuses to create over an existing environment unless
+// --force was given, in which case the old env and its kernel are removed.
+func prepareEnvDir(name, env string) bool {
+	if _, err := os.Stat(env); err != nil {
+		return true
+	}
+	if readPyvenvCfg(env) == nil {
+		printError(env + " exists and is not a virtual environment; refusing to replace it. Pick another --dir")
+		return false
+	}
+	if !forceFlag {
+		printError(fmt.Sprintf("Environment %s already exists at %s. Use --force to recreate it", name, env))
+		return false
+	}
+	if env == envPath("cloudlab") {
+		printError("Refusing to delete the main venv. Run: cloudlab reinstall jupyter")
+		return false
+	}
+	printWarning("Removing existing " + env)
 	jp := getJupyterPath()
-	if _, err := os.Stat(jp); err != nil {
-		printError("Jupyter not installed")
-		return
+	if _, err := os.Stat(jp); err == nil {
+		command(jp, "kernelspec", "uninstall", name, "-f").Run()
 	}
-	cmd := exec.Command(jp, "kernelspec", "list")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
+	if err := os.RemoveAll(env); err != nil {
+		printErrorCode(errCode(err), "Failed: "+err.Error())
+		return false
+	}
+	return true
 }
 
-func addKernel(name, ver string) {
-	printStep(fmt.Sprintf("Creating kernel %s with Python %s...", name, ver))
-	uv := getUVPath()
-	if uv == "" {
-		printError("UV not found")
-		return
+func venvArgs(path, python string, systemSite bool) []string {
+	args := []string{"venv", path, "--python", python}
+	if systemSite {
+		args = append(args, "--system-site-packages")
 	}
+	return args
+}
 
-	envPath := filepath.Join(cloudlabDir, "envs", name)
-	exec.Command(uv, "venv", envPath, "--python", ver).Run()
-
-	var py string
-	if runtime.GOOS == "windows" {
-		py = filepath.Join(envPath, "Scripts", "python.exe")
-	} else {
-		py = filepath.Join(envPath, "bin", "python")
+// pythonFor picks what `uv venv --python` gets: --python-path always wins,
+// python_executable stands in for python_version when no version was given.
+func pythonFor(ver string) (string, error) {
+	exe := pythonFlag
+	if exe == "" && ver == "" {
+		exe = config.PythonExe
 	}
+	if exe == "" {
+		if ver == "" {
+			ver = config.PythonVersion
+		}
+		return ver, nil
+	}
+	if _, err := checkPython(exe); err != nil {
+		return "", err
+	}
+	return exe, nil
+}
 
-	exec.Command(uv, "pip", "install", "ipykernel", "--python", py).Run()
-	exec.Command(py, "-m", "ipykernel", "install", "--user", "--name", name, "--display-name", fmt.Sprintf("Python %s (%s)", ver, name)).Run()
+// checkPython makes sure path is an executable Python 3 and returns its version.
+func checkPython(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("python not found: %s", path)
+	}
+	if info.IsDir() || (runtime.GOOS != "windows" && info.Mode()&0111 == 0) {
+		return "", fmt.Errorf("not an executable: %s", path)
+	}
+	out, err := command(path, "-c", "import sys; print('%d.%d.%d' % sys.version_info[:3])").Output()
+	ver := strings.TrimSpace(string(out))
+	if err != nil || !strings.HasPrefix(ver, "3.") {
+		return "", fmt.Errorf("%s is not a working Python 3 interpreter", path)
+	}
+	return ver, nil
+}
 
-	printSuccess(fmt.Sprintf("Kernel %s created", name))
+// readPyvenvCfg parses the key = value pairs uv writes to pyvenv.cfg, or
+// returns nil if path isn't an environment.
+func readPyvenvCfg(path string) map[string]string {
+	data, err := os.ReadFile(filepath.Join(path, "pyvenv.cfg"))
+	if err != nil {
+		return nil
+	}
+	cfg := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			cfg[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return cfg
 }
 
-func removeKernel(name string) {
-	printStep("Removing kernel " + name + "...")
-	jp := getJupyterPath()
-	if jp != "" {
-		exec.Command(jp, "kernelspec", "uninstall", name, "-f").Run()
+func installPkg(pkg string) {
+	printStep("Installing " + pkg + "...")
+	uv := getUVPath()
+	if uv == "" {
+		printErrorCode(codeNotInstalled, "UV not found")
+		return
 	}
-	os.RemoveAll(filepath.Join(cloudlabDir, "envs", name))
-	printSuccess("Kernel removed")
+	py := getPythonPath()
+	cmd := exec.Command(uv, "pip", "install", pkg, "--python", py)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Run()
+	printSuccess("Installed " + pkg)
 }
 
-// ==================== Environments ====================
+// ==================== Projects ====================
+
+// Project is a named working directory. `project use` switches
+// working_directory to it, and its env becomes the default env if set;
+// a project without one leaves default_env as it was.
+type Project struct {
+	Dir string `json:"dir"`
+	Env string `json:"env,omitempty"`
+}
 
-func handleEnv(args []string) {
+func handleProject(args []string) {
+	if len(args) == 0 {
+		listProjects()
+		return
+	}
 	switch args[0] {
-	case "list":
-		listEnvs()
-	case "create":
-		if len(args) < 3 {
-			printError("Usage: cloudlab env create <name> <version>")
+	case "list", "ls":
+		listProjects()
+	case "add":
+		names := positional(args[1:], "--env")
+		if len(names) < 2 {
+			printErrorCode(codeUsage, "Usage: cloudlab project add <name> <dir> [--env <env>]")
 			return
 		}
-		createEnv(args[1], args[2])
-	case "remove", "rm":
+		addProject(names[0], names[1], flagValue(args, "--env"))
+	case "use":
 		if len(args) < 2 {
-			printError("Usage: cloudlab env remove <name>")
+			printErrorCode(codeUsage, "Usage: cloudlab project use <name>")
 			return
 		}
-		os.RemoveAll(filepath.Join(cloudlabDir, "envs", args[1]))
-		printSuccess("Environment removed")
-	case "install":
+		useProject(args[1])
+	case "remove", "rm":
 		if len(args) < 2 {
-			printError("Usage: cloudlab env install <package>")
+			printErrorCode(codeUsage, "Usage: cloudlab project remove <name>")
 			return
 		}
-		installPkg(strings.Join(args[1:], " "))
+		if _, ok := config.Projects[args[1]]; !ok {
+			printErrorCode(codeNotFound, "Unknown project: "+args[1]+". Run: cloudlab project list")
+			return
+		}
+		delete(config.Projects, args[1])
+		saveConfig()
+		printSuccess("Project removed: " + args[1])
 	default:
-		printError("Unknown: " + args[0])
+		printErrorCode(codeUnknown, "Unknown: "+args[0])
 	}
 }
 
-func listEnvs() {
-	printHeader("🐍 ENVIRONMENTS")
-	venv := filepath.Join(cloudlabDir, "venv")
-	if _, err := os.Stat(venv); err == nil {
-		fmt.Printf("  %s★%s cloudlab (default)\n", BrightYellow, Reset)
+func listProjects() {
+	printHeader("📁 PROJECTS")
+	setJSONData(config.Projects)
+	if len(config.Projects) == 0 {
+		printInfo("No projects yet. Add one: cloudlab project add <name> <dir>")
+		return
 	}
-	entries, _ := os.ReadDir(filepath.Join(cloudlabDir, "envs"))
-	for _, e := range entries {
-		if e.IsDir() {
-			fmt.Printf("  %s○%s %s\n", Dim, Reset, e.Name())
+	names := make([]string, 0, len(config.Projects))
+	for name := range config.Projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		proj := config.Projects[name]
+		note := fmt.Sprintf(" %s→ %s%s", Dim, proj.Dir, Reset)
+		if proj.Env != "" {
+			note += fmt.Sprintf(" %s(env %s)%s", Dim, proj.Env, Reset)
+		}
+		if info, err := os.Stat(proj.Dir); err != nil || !info.IsDir() {
+			note += fmt.Sprintf(" %s(missing)%s", BrightRed, Reset)
+		}
+		if proj.Dir == config.WorkDir {
+			fmt.Printf("  %s★%s %s%s\n", BrightYellow, Reset, name, note)
+		} else {
+			fmt.Printf("  %s○%s %s%s\n", Dim, Reset, name, note)
 		}
 	}
 	fmt.Println()
 }
 
-func createEnv(name, ver string) {
-	printStep(fmt.Sprintf("Creating %s with Python %s...", name, ver))
-	uv := getUVPath()
-	if uv == "" {
-		printError("UV not found")
+func addProject(name, dir, env string) {
+	dir = expandPath(dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		printErrorCode(codeNotFound, "Directory not found: "+dir)
 		return
 	}
-	envPath := filepath.Join(cloudlabDir, "envs", name)
-	exec.Command(uv, "venv", envPath, "--python", ver).Run()
-	printSuccess("Environment created")
+	if env != "" && env != "cloudlab" && readPyvenvCfg(envPath(env)) == nil {
+		printErrorCode(codeNotFound, "Environment not found: "+env+". Run: cloudlab env list")
+		return
+	}
+	if config.Projects == nil {
+		config.Projects = map[string]Project{}
+	}
+	config.Projects[name] = Project{Dir: dir, Env: env}
+	saveConfig()
+	printSuccess(fmt.Sprintf("Project %s → %s", name, dir))
+	printInfo("Switch to it: cloudlab project use " + name)
 }
 
-func installPkg(pkg string) {
-	printStep("Installing " + pkg + "...")
-	uv := getUVPath()
-	if uv == "" {
-		printError("UV not found")
+func useProject(name string) {
+	proj, ok := config.Projects[name]
+	if !ok {
+		printErrorCode(codeNotFound, "Unknown project: "+name+". Run: cloudlab project list")
 		return
 	}
-	py := getPythonPath()
-	cmd := exec.Command(uv, "pip", "install", pkg, "--python", py)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
-	printSuccess("Installed " + pkg)
+	if info, err := os.Stat(proj.Dir); err != nil || !info.IsDir() {
+		printErrorCode(codeNotFound, "Directory not found: "+proj.Dir)
+		return
+	}
+	config.WorkDir = proj.Dir
+	if proj.Env == "cloudlab" {
+		config.DefaultEnv = ""
+	} else if proj.Env != "" {
+		config.DefaultEnv = proj.Env
+	}
+	saveConfig()
+	printSuccess(fmt.Sprintf("Using project %s (%s)", name, proj.Dir))
+	if proj.Env != "" {
+		printInfo("Default environment: " + envName(config.DefaultEnv))
+	} else {
+		printInfo("Default environment unchanged: " + envName(config.DefaultEnv) + " (project has no --env)")
+	}
+	if isRunning("jupyter") || isRunning("vscode") {
+		printInfo("Restart to open it in Jupyter and VS Code: cloudlab restart")
+	}
 }
 
 // ==================== Email ====================
@@ -1583,7 +8393,7 @@ func handleEmail(action string) {
 	case "send":
 		sendTunnelEmail()
 	default:
-		printError("Unknown: " + action)
+		printErrorCode(codeUnknown, "Unknown: "+action)
 	}
 }
 
@@ -1592,6 +8402,15 @@ func showEmailConfig() {
 	if config.Email != "" {
 		fmt.Printf("  Email: %s%s%s\n", BrightMagenta, config.Email, Reset)
 		fmt.Printf("  SMTP:  %s%s:%d%s\n", Dim, config.SMTPServer, config.SMTPPort, Reset)
+		if config.SMTPCACert != "" {
+			fmt.Printf("  CA:    %s%s%s\n", Dim, config.SMTPCACert, Reset)
+		}
+		if config.SMTPClientCert != "" {
+			fmt.Printf("  Cert:  %s%s%s\n", Dim, config.SMTPClientCert, Reset)
+		}
+		if config.SMTPInsecure {
+			printWarning("smtp_insecure_skip_verify is on: the server certificate is not checked")
+		}
 	} else {
 		printWarning("Email not configured. Run: cloudlab email setup")
 	}
@@ -1641,7 +8460,7 @@ func sendTestEmail() {
 </div></body></html>`, VERSION, AUTHOR, GITHUB)
 
 	if err := sendEmail("CloudLab - Test ✓", body); err != nil {
-		printError("Failed: " + err.Error())
+		printErrorCode(errCode(err), "Failed: "+err.Error())
 		return
 	}
 	printSuccess("Test email sent!")
@@ -1654,13 +8473,13 @@ func sendTunnelEmail() {
 	}
 	loadConfig()
 
-	if config.TunnelURLs.Jupyter == "" && config.TunnelURLs.VSCode == "" && config.TunnelURLs.SSH == "" && config.TunnelURLs.Dashboard == "" {
+	if config.TunnelURLs.Jupyter == "" && config.TunnelURLs.VSCode == "" && config.TunnelURLs.SSH == "" && config.TunnelURLs.Dashboard == "" && config.TunnelURLs.Viewer == "" {
 		printWarning("No tunnel URLs. Run: cloudlab tunnel start")
 		return
 	}
 
 	printStep("Sending tunnel URLs...")
-	hostname, _ := os.Hostname()
+	hostname := instanceName()
 
 	// Build sections
 	sections := ""
@@ -1706,6 +8525,16 @@ func sendTunnelEmail() {
 </div>`, config.TunnelURLs.Dashboard, config.TunnelURLs.Dashboard)
 	}
 
+	if config.TunnelURLs.Viewer != "" {
+		sections += fmt.Sprintf(`
+<div style="background:linear-gradient(135deg,#fef3c7,#fde68a);padding:24px;border-radius:12px;margin:20px 0;">
+<h2 style="color:#92400e;margin:0 0 12px;">👀 Jupyter (read-only)</h2>
+<p><strong>URL:</strong> <a href="%s">%s</a></p>
+<p><strong>Viewer password:</strong> <code style="background:#fef3c7;padding:4px 8px;border-radius:4px;">%s</code></p>
+<p style="font-size:12px;color:#92400e;">Safe to share: notebooks can be opened but not edited or run.</p>
+</div>`, config.TunnelURLs.Viewer, config.TunnelURLs.Viewer, config.ViewerPassword)
+	}
+
 	body := fmt.Sprintf(`<html><body style="font-family:sans-serif;padding:40px;background:#f5f5f5;">
 <div style="max-width:600px;margin:0 auto;background:white;padding:40px;border-radius:16px;box-shadow:0 4px 6px rgba(0,0,0,0.1);">
 <h1 style="color:#7c3aed;margin:0 0 10px;">☁️ CloudLab</h1>
@@ -1720,29 +8549,156 @@ func sendTunnelEmail() {
 </div></body></html>`, hostname, sections, config.WorkDir, VERSION, time.Now().Format("2006-01-02 15:04:05"), AUTHOR, GITHUB)
 
 	if err := sendEmail(fmt.Sprintf("☁️ CloudLab URLs - %s", hostname), body); err != nil {
-		printError("Failed: " + err.Error())
+		printErrorCode(errCode(err), "Failed: "+err.Error())
 		return
 	}
 	printSuccess("Tunnel URLs sent to " + config.Email)
 }
 
+// instanceName tells machines apart in notifications: instance_name if set,
+// otherwise the hostname.
+func instanceName() string {
+	if config.InstanceName != "" {
+		return config.InstanceName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// notifyServicesUp shows a desktop notification listing what's running
+// and its tunnel URL, for desktop_notify.
+func notifyServicesUp() {
+	var lines []string
+	for _, svc := range services() {
+		if !isRunning(svc.Name) {
+			continue
+		}
+		where := localAddr(svc.Port())
+		if url := *svc.URL(); url != "" && isRunning(svc.TunnelName()) {
+			where = url
+		}
+		lines = append(lines, svc.Label+": "+where)
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if err := desktopNotify("CloudLab is up", strings.Join(lines, "\n")); err != nil {
+		printWarning("Desktop notification failed: " + err.Error())
+	}
+}
+
+// desktopNotify uses notify-send on Linux, osascript on macOS and a
+// PowerShell toast on Windows. Text goes through the environment so it
+// needs no quoting.
+func desktopNotify(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", `display notification (system attribute "CLOUDLAB_BODY") with title (system attribute "CLOUDLAB_TITLE")`)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode($env:CLOUDLAB_TITLE)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode($env:CLOUDLAB_BODY)) > $null
+$app = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($app).Show([Windows.UI.Notifications.ToastNotification]::new($xml))`)
+	default:
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return fmt.Errorf("notify-send not found (install libnotify-bin)")
+		}
+		cmd = exec.Command("notify-send", "--app-name=CloudLab", title, body)
+	}
+	cmd.Env = append(os.Environ(), "CLOUDLAB_TITLE="+title, "CLOUDLAB_BODY="+body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// emailReady reports whether there's an address and some way to get its password.
+func emailReady() bool {
+	return config.Email != "" && (config.EmailPassword != "" || config.SMTPPasswordCmd != "")
+}
+
+// emailPassword runs smtp_password_command when set (e.g. `pass show
+// cloudlab/smtp`) so the secret never has to live in config.json, and
+// falls back to email_app_password otherwise.
+func emailPassword() (string, error) {
+	if config.SMTPPasswordCmd == "" {
+		return config.EmailPassword, nil
+	}
+	cmd := exec.CommandContext(rootCtx, "sh", "-c", config.SMTPPasswordCmd)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(rootCtx, "cmd", "/C", config.SMTPPasswordCmd)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runCmd("smtp_password_command", cmd); err != nil {
+		return "", err
+	}
+	pw, _, _ := strings.Cut(out.String(), "\n")
+	pw = strings.TrimSuffix(pw, "\r")
+	if pw == "" {
+		return "", fmt.Errorf("smtp_password_command printed nothing")
+	}
+	return pw, nil
+}
+
 func sendEmail(subject, body string) error {
+	password, err := emailPassword()
+	if err != nil {
+		return err
+	}
 	headers := fmt.Sprintf("From: CloudLab <%s>\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n",
 		config.Email, config.Email, subject)
 
-	addr := fmt.Sprintf("%s:%d", config.SMTPServer, config.SMTPPort)
+	addr := net.JoinHostPort(config.SMTPServer, strconv.Itoa(config.SMTPPort))
 
-	client, err := smtp.Dial(addr)
+	// smtp.Dial has no timeout, and networks that drop traffic to 587 would
+	// leave us hanging forever. The same budget then covers the whole exchange.
+	timeout := time.Duration(config.SMTPTimeout) * time.Second
+	conn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return fmt.Errorf("SMTP connection to %s timed out after %s — is port %d blocked?", addr, timeout, config.SMTPPort)
+		}
 		return err
 	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client, err := smtp.NewClient(conn, config.SMTPServer)
+	if err != nil {
+		conn.Close()
+		return smtpTimeoutError(err, addr, timeout)
+	}
 	defer client.Close()
+	return smtpTimeoutError(smtpSend(client, password, headers+body), addr, timeout)
+}
+
+// smtpTimeoutError explains a deadline hit partway through the exchange.
+func smtpTimeoutError(err error, addr string, timeout time.Duration) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("SMTP server %s stopped responding (no reply within smtp_timeout %s)", addr, timeout)
+	}
+	return err
+}
 
-	if err := client.StartTLS(&tls.Config{ServerName: config.SMTPServer}); err != nil {
+func smtpSend(client *smtp.Client, password, msg string) error {
+	tlsConfig, err := smtpTLSConfig()
+	if err != nil {
+		return err
+	}
+	if err := client.StartTLS(tlsConfig); err != nil {
 		return err
 	}
 
-	auth := smtp.PlainAuth("", config.Email, config.EmailPassword, config.SMTPServer)
+	auth := smtp.PlainAuth("", config.Email, password, config.SMTPServer)
 	if err := client.Auth(auth); err != nil {
 		return err
 	}
@@ -1758,7 +8714,7 @@ func sendEmail(subject, body string) error {
 	if err != nil {
 		return err
 	}
-	w.Write([]byte(headers + body))
+	w.Write([]byte(msg))
 	return w.Close()
 }
 
@@ -1768,8 +8724,11 @@ func updateAll() {
 	printHeader("🔄 UPDATING")
 	uv := getUVPath()
 	if uv != "" {
-		py := getPythonPath()
-		exec.Command(uv, "pip", "install", "--upgrade", "jupyterlab", "notebook", "--python", py).Run()
+		py := envPython(envPath("cloudlab"))
+		if err := runCmd("pip install --upgrade", command(uv, "pip", "install", "--upgrade", "jupyterlab", "notebook", "--python", py)); err != nil {
+			printErrorCode(errCode(err), err.Error())
+			return
+		}
 	}
 	printSuccess("Updated!")
 }
@@ -1787,8 +8746,37 @@ func uninstallAll() {
 
 // ==================== Helpers ====================
 
+// openCloudlabDir shows where CloudLab keeps its files and, when there's a
+// desktop to show them on, opens the folder in the file manager.
+func openCloudlabDir() {
+	printInfo("Data:   " + cloudlabDir)
+	printInfo("Config: " + configPath)
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("open", cloudlabDir)
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("explorer", cloudlabDir)
+	case isWSL():
+		cmd = exec.Command("explorer.exe", ".")
+		cmd.Dir = cloudlabDir
+	case os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != "":
+		cmd = exec.Command("xdg-open", cloudlabDir)
+	default:
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		printWarning("Couldn't open a file manager: " + err.Error())
+	}
+}
+
 func downloadFile(path, url string) error {
-	resp, err := http.Get(url)
+	client := &http.Client{Timeout: installTimeout()}
+	req, err := http.NewRequestWithContext(rootCtx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -1804,15 +8792,256 @@ func downloadFile(path, url string) error {
 	return err
 }
 
+// command is exec.Command for helper processes whose output is normally
+// hidden; with --verbose it goes straight to the terminal instead.
+func command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(rootCtx, name, args...)
+	if verboseFlag {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	return cmd
+}
+
+// runCmd runs cmd and, on failure, wraps the error with name and the tail of
+// whatever the command wrote to stderr, so callers can report more than
+// "exit status 1". The command is killed once installTimeout has passed so a
+// stalled download can't hang the CLI.
+func runCmd(name string, cmd *exec.Cmd) error {
+	ctx := rootCtx
+	if timeout := installTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(rootCtx, timeout)
+		defer cancel()
+	}
+	// Callers build cmd before the timeout is known, so run a copy bound to ctx.
+	run := exec.CommandContext(ctx, cmd.Path, cmd.Args[1:]...)
+	run.Dir, run.Env, run.Stdin, run.Stdout, run.SysProcAttr = cmd.Dir, cmd.Env, cmd.Stdin, cmd.Stdout, cmd.SysProcAttr
+	var stderr bytes.Buffer
+	if cmd.Stderr == nil {
+		run.Stderr = &stderr
+	} else {
+		run.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	}
+	// Children of a killed "curl | sh" may keep the pipes open; don't wait on them.
+	run.WaitDelay = 5 * time.Second
+	if err := run.Run(); err != nil {
+		if rootCtx.Err() != nil {
+			return &codedError{codeTimeout, fmt.Errorf("%s: stopped at --deadline", name)}
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return &codedError{codeTimeout, fmt.Errorf("%s: timed out after %s (raise install_timeout or pass --timeout)", name, installTimeout())}
+		}
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if len(lines) > 20 {
+			lines = lines[len(lines)-20:]
+		}
+		return fmt.Errorf("%s: %w\n%s", name, err, strings.Join(lines, "\n"))
+	}
+	return nil
+}
+
+func exitIfDeadline(d time.Duration) {
+	if rootCtx.Err() == context.DeadlineExceeded {
+		printErrorCode(codeTimeout, fmt.Sprintf("Deadline of %s exceeded", d))
+		exit(124)
+	}
+}
+
+// sleepCtx sleeps for d and reports false if --deadline passed meanwhile.
+func sleepCtx(d time.Duration) bool {
+	select {
+	case <-rootCtx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// installTimeout bounds each installer, pip and download step; --timeout
+// overrides install_timeout for a single run. Zero means no limit.
+func installTimeout() time.Duration {
+	if timeoutFlag > 0 {
+		return timeoutFlag
+	}
+	return time.Duration(config.InstallTimeout) * time.Minute
+}
+
+// parseMinutes accepts a Go duration ("90s", "10m") or a bare number of minutes.
+func parseMinutes(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Minute, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func removeArg(args []string, name string) []string {
+	var out []string
+	for _, a := range args {
+		if a != name {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func hasFlag(args []string, names ...string) bool {
+	for _, a := range args {
+		for _, n := range names {
+			if a == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeFlag drops a value flag given as "name value" or "name=value".
+func removeFlag(args []string, name string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == name {
+			i++
+			continue
+		}
+		if !strings.HasPrefix(args[i], name+"=") {
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
+
+func flagValue(args []string, name string) string {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(a, name+"=") {
+			return strings.TrimPrefix(a, name+"=")
+		}
+	}
+	return ""
+}
+
+func positional(args []string, valueFlags ...string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if strings.HasPrefix(a, "-") {
+			if hasFlag(valueFlags, a) {
+				i++
+			}
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func expandPath(p string) string {
+	p = os.ExpandEnv(strings.TrimSpace(p))
+	if p == "~" {
+		p = homeDir
+	} else if strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		p = filepath.Join(homeDir, p[2:])
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return p
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func genToken(n int) string {
 	b := make([]byte, n)
 	rand.Read(b)
 	return hex.EncodeToString(b)[:n]
 }
 
+func maskSecret(s string) string {
+	if s == "" {
+		return "(not set)"
+	}
+	return strings.Repeat("*", 8)
+}
+
+func maskEmail(s string) string {
+	at := strings.Index(s, "@")
+	if at <= 1 {
+		return s
+	}
+	return s[:1] + strings.Repeat("*", at-1) + s[at:]
+}
+
 func savePID(name string, pid int) {
 	path := filepath.Join(cloudlabDir, "pids", name+".pid")
 	os.WriteFile(path, []byte(strconv.Itoa(pid)), 0644)
+	recordRunning(name, true)
+}
+
+// last_running.json is everything started and not deliberately stopped
+// since, so `cloudlab resume` can bring it back after a reboot or crash.
+// Unlike pid files it isn't cleaned up when a process dies.
+var lastRunningMu sync.Mutex
+
+func lastRunningPath() string {
+	return filepath.Join(cloudlabDir, "last_running.json")
+}
+
+func loadLastRunning() (map[string]bool, bool) {
+	data, err := os.ReadFile(lastRunningPath())
+	if err != nil {
+		return map[string]bool{}, false
+	}
+	var names []string
+	json.Unmarshal(data, &names)
+	set := map[string]bool{}
+	for _, n := range names {
+		set[n] = true
+	}
+	return set, true
+}
+
+func recordRunning(name string, running bool) {
+	lastRunningMu.Lock()
+	defer lastRunningMu.Unlock()
+	set, _ := loadLastRunning()
+	if set[name] == running {
+		return
+	}
+	if running {
+		set[name] = true
+	} else {
+		delete(set, name)
+	}
+	names := make([]string, 0, len(set))
+	for n := range set {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	data, _ := json.MarshalIndent(names, "", "  ")
+	os.WriteFile(lastRunningPath(), data, 0644)
 }
 
 func getPID(name string) int {
@@ -1825,6 +9054,12 @@ func getPID(name string) int {
 }
 
 func stopPID(name string) {
+	stopPIDWithin(name, 500*time.Millisecond)
+}
+
+// stopPIDWithin sends SIGTERM and kills the process if it's still there
+// after grace.
+func stopPIDWithin(name string, grace time.Duration) {
 	pid := getPID(name)
 	if pid == 0 {
 		return
@@ -1834,11 +9069,14 @@ func stopPID(name string) {
 	} else {
 		if p, err := os.FindProcess(pid); err == nil {
 			p.Signal(syscall.SIGTERM)
-			time.Sleep(500 * time.Millisecond)
+			for deadline := time.Now().Add(grace); time.Now().Before(deadline) && isRunning(name); {
+				time.Sleep(100 * time.Millisecond)
+			}
 			p.Kill()
 		}
 	}
 	os.Remove(filepath.Join(cloudlabDir, "pids", name+".pid"))
+	recordRunning(name, false)
 }
 
 func isRunning(name string) bool {
@@ -1857,27 +9095,170 @@ func isRunning(name string) bool {
 	return p.Signal(syscall.Signal(0)) == nil
 }
 
+// jsonResult is the single object --output json prints when the command
+// finishes; everything the command would have printed is captured instead.
+type jsonResult struct {
+	OK       bool     `json:"ok"`
+	Error    string   `json:"error,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Messages []string `json:"messages,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Output   string   `json:"output,omitempty"`
+	Data     any      `json:"data,omitempty"`
+}
+
+var (
+	outputJSON bool
+	jsonMu     sync.Mutex
+	jsonOut    jsonResult
+	realStdout *os.File
+	captured   chan string
+)
+
+var ansiRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// beginJSONOutput points os.Stdout at a pipe so decorative output (and that
+// of child processes) is collected rather than shown.
+func beginJSONOutput() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	outputJSON = true
+	realStdout, os.Stdout = os.Stdout, w
+	captured = make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(r)
+		captured <- ansiRe.ReplaceAllString(string(data), "")
+	}()
+}
+
+// setJSONData attaches a command's structured result to the --output json object.
+func setJSONData(v any) {
+	jsonMu.Lock()
+	jsonOut.Data = v
+	jsonMu.Unlock()
+}
+
+// exit ends the process, printing the --output json result first.
+func exit(code int) {
+	if outputJSON {
+		outputJSON = false
+		os.Stdout.Close()
+		os.Stdout = realStdout
+		jsonOut.Output = strings.TrimSpace(<-captured)
+		if jsonOut.Error != "" && code == 0 {
+			code = 1
+		}
+		jsonOut.OK = code == 0
+		if !jsonOut.OK && jsonOut.Code == "" {
+			jsonOut.Code = "exit_status"
+		}
+		data, _ := json.Marshal(jsonOut)
+		fmt.Println(string(data))
+	}
+	os.Exit(code)
+}
+
+// Error codes reported in the "code" field of --output json.
+const (
+	codeError        = "error"
+	codeUsage        = "usage"
+	codeUnknown      = "unknown_command"
+	codeNotInstalled = "not_installed"
+	codeNotFound     = "not_found"
+	codePortInUse    = "port_in_use"
+	codeTimeout      = "timeout"
+	codePermission   = "permission_denied"
+	codeInvalid      = "invalid_value"
+)
+
+// codedError tags an error with the code --output json reports for it.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// errCode picks the --output json code for err.
+func errCode(err error) string {
+	var ce *codedError
+	switch {
+	case errors.As(err, &ce):
+		return ce.code
+	case errors.Is(err, context.DeadlineExceeded):
+		return codeTimeout
+	case errors.Is(err, os.ErrPermission):
+		return codePermission
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return codeNotFound
+	case errors.Is(err, syscall.EADDRINUSE):
+		return codePortInUse
+	}
+	return codeError
+}
+
+func recordJSON(list *[]string, s string) bool {
+	if !outputJSON {
+		return false
+	}
+	jsonMu.Lock()
+	*list = append(*list, s)
+	jsonMu.Unlock()
+	return true
+}
+
 func printHeader(s string) {
+	if outputJSON {
+		return
+	}
 	fmt.Printf("\n%s%s%s\n", Bold+BrightWhite, s, Reset)
 	fmt.Printf("%s%s%s\n", Dim, strings.Repeat("─", 50), Reset)
 }
 
 func printStep(s string) {
+	if outputJSON {
+		return
+	}
 	fmt.Printf("  %s▶%s %s\n", BrightBlue, Reset, s)
 }
 
 func printSuccess(s string) {
+	if recordJSON(&jsonOut.Messages, s) {
+		return
+	}
 	fmt.Printf("  %s✓%s %s\n", BrightGreen, Reset, s)
 }
 
 func printError(s string) {
+	printErrorCode(codeError, s)
+}
+
+// printErrorCode is printError with the code --output json reports.
+func printErrorCode(code, s string) {
+	if outputJSON {
+		jsonMu.Lock()
+		if jsonOut.Error == "" {
+			jsonOut.Error, jsonOut.Code = s, code
+		}
+		jsonMu.Unlock()
+		return
+	}
 	fmt.Printf("  %s✗%s %s\n", BrightRed, Reset, s)
 }
 
 func printWarning(s string) {
+	if recordJSON(&jsonOut.Warnings, s) {
+		return
+	}
 	fmt.Printf("  %s⚠%s %s\n", BrightYellow, Reset, s)
 }
 
 func printInfo(s string) {
+	if recordJSON(&jsonOut.Messages, s) {
+		return
+	}
 	fmt.Printf("  %s💡%s %s\n", BrightBlue, Reset, s)
 }
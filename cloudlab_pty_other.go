@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// startPTY is only implemented on Linux; elsewhere the built-in terminal
+// talks to the shell over plain pipes.
+func startPTY(cmd *exec.Cmd) (*os.File, func(cols, rows int), error) {
+	return nil, nil, errors.New("no pty support on this platform")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBindAndLocalAddr(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	tests := []struct {
+		bindAddress string
+		bind        string   // bindAddress()
+		jupyter     []string // jupyterBindArgs(8080)
+		vscode      string   // vscodeBindArg(8080)
+		ttyd        []string // terminalBindArgs("ttyd", 8080)
+		gotty       []string // terminalBindArgs("gotty", 8080)
+		local       string   // localAddr(), used for health checks and tunnels
+	}{
+		{"", "0.0.0.0",
+			[]string{"--ip=0.0.0.0", "--port=8080"}, "--bind-addr=0.0.0.0:8080",
+			[]string{"--port", "8080", "--writable"}, []string{"-w", "-p", "8080"}, "127.0.0.1:8080"},
+		{"127.0.0.1", "127.0.0.1",
+			[]string{"--ip=127.0.0.1", "--port=8080"}, "--bind-addr=127.0.0.1:8080",
+			[]string{"--port", "8080", "--writable", "--interface", "127.0.0.1"}, []string{"-w", "-p", "8080", "--address", "127.0.0.1"}, "127.0.0.1:8080"},
+		{"0.0.0.0", "0.0.0.0",
+			[]string{"--ip=0.0.0.0", "--port=8080"}, "--bind-addr=0.0.0.0:8080",
+			[]string{"--port", "8080", "--writable"}, []string{"-w", "-p", "8080"}, "127.0.0.1:8080"},
+		{"::1", "::1",
+			[]string{"--ip=::1", "--port=8080"}, "--bind-addr=[::1]:8080",
+			[]string{"--port", "8080", "--writable", "--interface", "::1"}, []string{"-w", "-p", "8080", "--address", "::1"}, "[::1]:8080"},
+		{"::", "::",
+			[]string{"--ip=::", "--port=8080"}, "--bind-addr=[::]:8080",
+			[]string{"--port", "8080", "--writable"}, []string{"-w", "-p", "8080"}, "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		config.BindAddress = tt.bindAddress
+		if got := bindAddress(); got != tt.bind {
+			t.Errorf("bind_address %q: bindAddress() = %q, want %q", tt.bindAddress, got, tt.bind)
+		}
+		if got := jupyterBindArgs(8080); !slices.Equal(got, tt.jupyter) {
+			t.Errorf("bind_address %q: jupyter args = %q, want %q", tt.bindAddress, got, tt.jupyter)
+		}
+		if got := vscodeBindArg(8080); got != tt.vscode {
+			t.Errorf("bind_address %q: code-server arg = %q, want %q", tt.bindAddress, got, tt.vscode)
+		}
+		if got := terminalBindArgs("ttyd", 8080); !slices.Equal(got, tt.ttyd) {
+			t.Errorf("bind_address %q: ttyd args = %q, want %q", tt.bindAddress, got, tt.ttyd)
+		}
+		if got := terminalBindArgs("gotty", 8080); !slices.Equal(got, tt.gotty) {
+			t.Errorf("bind_address %q: gotty args = %q, want %q", tt.bindAddress, got, tt.gotty)
+		}
+		builtin := []string{webTerminalCmd, "--port", "8080", "--bind", tt.bind}
+		if got := terminalBindArgs("builtin", 8080); !slices.Equal(got, builtin) {
+			t.Errorf("bind_address %q: built-in terminal args = %q, want %q", tt.bindAddress, got, builtin)
+		}
+		if got := localAddr(8080); got != tt.local {
+			t.Errorf("bind_address %q: localAddr(8080) = %q, want %q", tt.bindAddress, got, tt.local)
+		}
+	}
+}
+
+func TestTunnelURLFromLog(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	tests := []struct {
+		name    string
+		pattern string // tunnel_url_pattern
+		log     string
+		want    string
+	}{
+		{
+			name: "quick tunnel",
+			log: `2026-01-02T10:00:00Z INF Requesting new quick Tunnel on trycloudflare.com...
+2026-01-02T10:00:02Z INF |  Your quick Tunnel has been created! Visit it at (it may take some time to be reachable):  |
+2026-01-02T10:00:02Z INF |  https://shiny-river-moon-lamp.trycloudflare.com                                           |
+2026-01-02T10:00:03Z INF Registered tunnel connection connIndex=0 location=ams01 protocol=quic`,
+			want: "https://shiny-river-moon-lamp.trycloudflare.com",
+		},
+		{
+			name: "named tunnel",
+			log: `2026-01-02T10:00:00Z INF Starting tunnel tunnelID=6ff42ae2-765d-4adf-8112-31c55c1551ef
+2026-01-02T10:00:01Z INF Route https://6ff42ae2-765d-4adf-8112-31c55c1551ef.cfargotunnel.com`,
+			want: "https://6ff42ae2-765d-4adf-8112-31c55c1551ef.cfargotunnel.com",
+		},
+		{
+			name:    "tunnel_url_pattern",
+			pattern: `lab\.example\.com`,
+			log: `2026-01-02T10:00:00Z INF Starting tunnel tunnelID=6ff42ae2-765d-4adf-8112-31c55c1551ef
+2026-01-02T10:00:01Z INF Updated to new configuration ingress hostname=lab.example.com`,
+			want: "https://lab.example.com",
+		},
+		{
+			name: "api error is not a URL",
+			log: `2026-01-02T10:00:00Z INF Requesting new quick Tunnel on trycloudflare.com...
+2026-01-02T10:00:05Z ERR Error unmarshaling QuickTunnel response: error="invalid character '<'" status_code="502 Bad Gateway" url=https://api.trycloudflare.com/tunnel
+failed to request quick Tunnel: unexpected response`,
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		config.TunnelPattern = tt.pattern
+		if got := tunnelURLFromLog(tt.log); got != tt.want {
+			t.Errorf("%s: tunnelURLFromLog() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestWebTerminalScript catches control characters or line breaks pasted
+// into the page's inline script, which break it in the browser.
+func TestWebTerminalScript(t *testing.T) {
+	start := strings.LastIndex(webTerminalPage, "<script>")
+	end := strings.LastIndex(webTerminalPage, "</script>")
+	if start < 0 || end < start {
+		t.Fatal("no inline <script> in webTerminalPage")
+	}
+	script := webTerminalPage[start+len("<script>") : end]
+	var quote rune
+	escaped := false
+	for i, r := range script {
+		if r < 0x20 && r != '\n' || r == 0x7f {
+			t.Errorf("raw control character %#x at offset %d", r, i)
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0 && r == '\n':
+			t.Errorf("line break inside a %c string at offset %d", quote, i)
+			quote = 0
+		case r == quote:
+			quote = 0
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+		}
+	}
+	if strings.Contains(script, "(//") {
+		t.Error("empty regex literal, parsed as a comment")
+	}
+}
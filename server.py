@@ -16,7 +16,9 @@ import signal
 import sys
 
 PORT = int(os.environ.get('CLOUDLAB_PORT', 3000))
-CLOUDLAB_DIR = os.path.expanduser('~/.cloudlab')
+BIND = os.environ.get('CLOUDLAB_BIND', '0.0.0.0')
+CLOUDLAB_DIR = os.environ.get('CLOUDLAB_DIR', os.path.expanduser('~/.cloudlab'))
+CLOUDLAB_CONFIG = os.environ.get('CLOUDLAB_CONFIG', os.path.join(CLOUDLAB_DIR, 'config.json'))
 
 class Colors:
     CYAN = '\033[96m'
@@ -62,7 +64,7 @@ def check_service(name, port):
 def get_config():
     """Load configuration"""
     try:
-        with open(os.path.join(CLOUDLAB_DIR, 'config.json'), 'r') as f:
+        with open(CLOUDLAB_CONFIG, 'r') as f:
             return json.load(f)
     except:
         return {}
@@ -117,16 +119,17 @@ def list_kernels():
 def list_envs():
     """List Python environments"""
     envs = []
+    default = get_config().get('default_env') or 'cloudlab'
     venv = os.path.join(CLOUDLAB_DIR, 'venv')
     if os.path.exists(venv):
-        envs.append({'name': 'cloudlab', 'default': True, 'path': venv})
+        envs.append({'name': 'cloudlab', 'default': default == 'cloudlab', 'path': venv})
     
     envs_dir = os.path.join(CLOUDLAB_DIR, 'envs')
     if os.path.exists(envs_dir):
         for name in os.listdir(envs_dir):
             path = os.path.join(envs_dir, name)
             if os.path.isdir(path):
-                envs.append({'name': name, 'default': False, 'path': path})
+                envs.append({'name': name, 'default': name == default, 'path': path})
     
     return envs
 
@@ -270,6 +273,7 @@ class DashboardHandler(http.server.BaseHTTPRequestHandler):
 
 class ReuseAddrServer(socketserver.TCPServer):
     allow_reuse_address = True
+    address_family = socket.AF_INET6 if ':' in BIND else socket.AF_INET
 
 def signal_handler(sig, frame):
     print(f"\n{Colors.YELLOW}Shutting down dashboard server...{Colors.RESET}")
@@ -299,7 +303,7 @@ def main():
 """)
 
     try:
-        with ReuseAddrServer(('0.0.0.0', PORT), DashboardHandler) as server:
+        with ReuseAddrServer((BIND, PORT), DashboardHandler) as server:
             server.serve_forever()
     except OSError as e:
         if 'Address already in use' in str(e):